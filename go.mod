@@ -3,10 +3,13 @@ module github.com/bitsbeats/drone-helm3
 go 1.13
 
 require (
+	github.com/Masterminds/semver/v3 v3.1.1
 	github.com/drone/envsubst v1.0.3
 	github.com/golang/mock v1.6.0
 	github.com/google/go-cmp v0.3.1
 	github.com/jinzhu/copier v0.4.0
 	github.com/joho/godotenv v1.5.1
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/xeipuuv/gojsonschema v1.2.0
+	sigs.k8s.io/yaml v1.3.0
 )
@@ -4,23 +4,65 @@ type ErrorKind string
 
 const (
 	// PreFail is used if anything before the helm deployment fails
-	PreFailErrorKind = "prefail"
+	PreFailErrorKind ErrorKind = "prefail"
 
 	// PostFailErrorKind is used if a postcmd fails
-	PostFailErrorKind = "postfail"
+	PostFailErrorKind ErrorKind = "postfail"
 
 	// Failed is used if the deployment failed
-	FailedErrorKind = "failed"
+	FailedErrorKind ErrorKind = "failed"
 
 	// TestsFailed is used if the deployment is successful but the
 	// `helm test` failed and rollback is not specified
-	TestFailedErrorKind = "test_failed"
+	TestFailedErrorKind ErrorKind = "test_failed"
 
-	// RollbackSuccess is used if the deployment was successful, the tests
-	// failed and the rollback was successful
-	RollbackSuccessErrorKind = "rollback_success"
+	// RollbackSuccess is used if a step failed, like the upgrade with
+	// rollback on failure, the tests or the smoke checks, and the rollback
+	// was successful
+	RollbackSuccessErrorKind ErrorKind = "rollback_success"
 
-	// RollbackFailed is used if the deployment was successful the tests
-	// failed and the rollback failed also
-	RollbackFailedErrorKind = "rollback_failed"
+	// RollbackFailed is used if a step failed and the rollback failed also
+	RollbackFailedErrorKind ErrorKind = "rollback_failed"
+
+	// VerifyFailed is used if the deployment was successful but not all
+	// workloads of the release became healthy
+	VerifyFailedErrorKind ErrorKind = "verify_failed"
+
+	// SmokeFailed is used if the deployment was successful but the smoke
+	// checks failed and rollback is not specified
+	SmokeFailedErrorKind ErrorKind = "smoke_failed"
+
+	// Cancelled is used if the plugin received a termination signal
+	CancelledErrorKind ErrorKind = "cancelled"
+
+	// Frozen is used if the deployment was blocked by a freeze window
+	FrozenErrorKind ErrorKind = "frozen"
+
+	// ManifestDenied is used if the checks of the rendered manifest denied
+	// the deployment
+	ManifestDeniedErrorKind ErrorKind = "manifest_denied"
 )
+
+// exitCodes maps the error kinds to process exit codes, 1 is reserved for
+// undefined errors
+var exitCodes = map[ErrorKind]int{
+	PreFailErrorKind:         2,
+	FailedErrorKind:          3,
+	PostFailErrorKind:        4,
+	TestFailedErrorKind:      5,
+	RollbackSuccessErrorKind: 6,
+	RollbackFailedErrorKind:  7,
+	VerifyFailedErrorKind:    8,
+	SmokeFailedErrorKind:     9,
+	CancelledErrorKind:       10,
+	FrozenErrorKind:          11,
+	ManifestDeniedErrorKind:  12,
+}
+
+// ExitCode returns the process exit code for the error kind
+func (k ErrorKind) ExitCode() int {
+	if code, ok := exitCodes[k]; ok {
+		return code
+	}
+	return 1
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/bitsbeats/drone-helm3/internal/helm"
@@ -24,6 +25,9 @@ type (
 		// Status is used to propagate a status, always exits the
 		// program
 		Status(status error, message string, v ...interface{})
+
+		// Info attaches additional information to the reported status
+		Info(key string, value string)
 	}
 )
 
@@ -34,6 +38,8 @@ type Pushgateway struct {
 	Namespace      string
 	Release        string
 	PushGatewayURL string
+
+	labels map[string]string
 }
 
 func NewPushgateway(repo, namespace, release, pushGatewayURL string) *Pushgateway {
@@ -42,25 +48,47 @@ func NewPushgateway(repo, namespace, release, pushGatewayURL string) *Pushgatewa
 		Namespace:      namespace,
 		Release:        release,
 		PushGatewayURL: pushGatewayURL,
+		labels:         map[string]string{},
 	}
 }
 
+func (e *Pushgateway) Info(key string, value string) {
+	e.labels[key] = value
+	(&Log{}).Info(key, value)
+}
+
 func (e *Pushgateway) Fatalf(message string, v ...interface{}) {
 	(&Log{}).Fatalf(message, v...)
 }
 
 func (e *Pushgateway) Status(status error, message string, v ...interface{}) {
 	msg := ""
+	kind := ""
 	if status == nil {
 		msg = "success"
+		kind = "success"
 	} else if wrappedErr, ok := status.(*helm.HelmError); ok {
 		msg = wrappedErr.Error()
+		kind = string(wrappedErr.Kind)
+		if wrappedErr.Phase != "" {
+			e.labels["timed_out_phase"] = wrappedErr.Phase
+		}
 	} else {
 		msg = "undefined"
+		kind = "undefined"
 	}
 
 	buffer := bytes.NewBuffer([]byte("# TYPE drone_helm3_build_status gauge\n"))
-	_, _ = fmt.Fprintf(buffer, "drone_helm3_build_status{status=%q} %d\n", msg, time.Now().Unix())
+	labels := fmt.Sprintf("status=%q,kind=%q", msg, kind)
+	keys := make([]string, 0, len(e.labels))
+	for key := range e.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels += fmt.Sprintf(",%s=%q", key, e.labels[key])
+	}
+	_, _ = fmt.Fprintf(buffer, "drone_helm3_build_status{%s} %d\n", labels, time.Now().Unix())
 	url := fmt.Sprintf(
 		"%s/job/drone_helm3/repo@base64/%s/namespace@base64/%s/release@base64/%s",
 		e.PushGatewayURL,
@@ -93,6 +121,40 @@ func (e *Pushgateway) Status(status error, message string, v ...interface{}) {
 	(&Log{}).Status(status, message, v...)
 }
 
+// Cleanup is a Handler that runs cleanup functions before the wrapped
+// Handler exits the program
+type Cleanup struct {
+	Handler
+
+	funcs []func()
+}
+
+func NewCleanup(handler Handler) *Cleanup {
+	return &Cleanup{Handler: handler}
+}
+
+// Add registers a cleanup function, they run in reverse order
+func (e *Cleanup) Add(f func()) {
+	e.funcs = append(e.funcs, f)
+}
+
+func (e *Cleanup) Fatalf(message string, v ...interface{}) {
+	e.run()
+	e.Handler.Fatalf(message, v...)
+}
+
+func (e *Cleanup) Status(status error, message string, v ...interface{}) {
+	e.run()
+	e.Handler.Status(status, message, v...)
+}
+
+func (e *Cleanup) run() {
+	for i := len(e.funcs) - 1; i >= 0; i-- {
+		e.funcs[i]()
+	}
+	e.funcs = nil
+}
+
 // Log is a Handler implementation that just logs
 // Note: this is used by other Handlers, more specific code should always go
 //       into a more specific implementation
@@ -106,12 +168,17 @@ func (e *Log) Fatalf(message string, v ...interface{}) {
 	log.Fatalf(message, v...)
 }
 
+func (e *Log) Info(key string, value string) {
+	log.Printf("%s: %s", key, value)
+}
+
 func (e *Log) Status(status error, message string, v ...interface{}) {
 	if status == nil {
 		log.Printf(message, v...)
 		os.Exit(0)
-	} else if _, ok := status.(*helm.HelmError); ok {
-		log.Fatalf(message, v...)
+	} else if wrappedErr, ok := status.(*helm.HelmError); ok {
+		log.Printf(message, v...)
+		os.Exit(wrappedErr.Kind.ExitCode())
 	} else {
 		log.Printf("undefined status reported: %+v", status)
 		log.Fatalf(message, v...)
@@ -0,0 +1,378 @@
+package freeze
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	// the final image has no zoneinfo
+	_ "time/tzdata"
+
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// Window is a period in which deployments are frozen, either a cron-like
+	// schedule of the frozen minutes or a date range
+	Window struct {
+		Spec string
+
+		location *time.Location
+
+		// start and end of a date range, the end is exclusive
+		start time.Time
+		end   time.Time
+
+		// schedule is set for cron-like windows
+		schedule *schedule
+	}
+
+	// schedule holds the allowed values of each cron field as bitmask
+	schedule struct {
+		minute, hour, dom, month, dow uint64
+		domStar, dowStar              bool
+	}
+
+	// Checker decides if a deployment is allowed at the current time
+	Checker struct {
+		Windows  []*Window
+		Override bool
+
+		now func() time.Time
+	}
+
+	CheckerOption func(*Checker)
+
+	// FrozenError is returned if the deployment falls into a freeze window
+	FrozenError struct {
+		Window *Window
+		Now    time.Time
+
+		// Until is the end of the freeze, zero if it is more than a year away
+		Until time.Time
+	}
+
+	cronField struct {
+		name     string
+		min, max int
+		names    []string
+	}
+)
+
+var (
+	dateLayouts = []string{
+		"2006-01-02",
+		"2006-01-02T15:04",
+		"2006-01-02T15:04:05",
+		time.RFC3339,
+	}
+
+	cronFields = []cronField{
+		{name: "minute", min: 0, max: 59},
+		{name: "hour", min: 0, max: 23},
+		{name: "day of month", min: 1, max: 31},
+		{name: "month", min: 1, max: 12, names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+		{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+	}
+)
+
+func (e *FrozenError) Error() string {
+	until := "further notice"
+	if !e.Until.IsZero() {
+		until = e.Until.In(e.Window.location).Format("2006-01-02 15:04 MST")
+	}
+	return fmt.Sprintf("deployments are frozen by window %q until %s, set freeze_override to deploy anyway", e.Window.Spec, until)
+}
+
+// Parse parses the freeze windows, separated by newlines or semicolons, or
+// as YAML/JSON list
+func Parse(spec string) ([]*Window, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	specs := []string{}
+	if strings.HasPrefix(spec, "[") {
+		err := yaml.Unmarshal([]byte(spec), &specs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse freeze windows: %s", err)
+		}
+	} else {
+		specs = strings.FieldsFunc(spec, func(r rune) bool {
+			return r == '\n' || r == ';'
+		})
+	}
+
+	windows := []*Window{}
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		window, err := ParseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// ParseWindow parses a single freeze window, either five cron fields or a
+// start/end date range, each optionally followed by a time zone
+func ParseWindow(spec string) (*Window, error) {
+	spec = strings.TrimSpace(spec)
+	window := &Window{Spec: spec, location: time.UTC}
+	fields := strings.Fields(spec)
+
+	switch len(fields) {
+	case 1, 2:
+		if len(fields) == 2 {
+			location, err := time.LoadLocation(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid time zone in freeze window %q: %s", spec, err)
+			}
+			window.location = location
+		}
+		err := window.parseRange(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid freeze window %q: %s", spec, err)
+		}
+	case 5, 6:
+		if len(fields) == 6 {
+			location, err := time.LoadLocation(fields[5])
+			if err != nil {
+				return nil, fmt.Errorf("invalid time zone in freeze window %q: %s", spec, err)
+			}
+			window.location = location
+		}
+		schedule, err := parseSchedule(fields[:5])
+		if err != nil {
+			return nil, fmt.Errorf("invalid freeze window %q: %s", spec, err)
+		}
+		window.schedule = schedule
+	default:
+		return nil, fmt.Errorf("invalid freeze window %q: expected a start/end date range or five cron fields", spec)
+	}
+	return window, nil
+}
+
+// Contains reports if t is inside the window
+func (w *Window) Contains(t time.Time) bool {
+	if w.schedule == nil {
+		return !t.Before(w.start) && t.Before(w.end)
+	}
+	return w.schedule.matches(t.In(w.location))
+}
+
+func (w *Window) String() string {
+	return w.Spec
+}
+
+// parseRange parses a start/end range, an end without time includes the
+// whole day
+func (w *Window) parseRange(spec string) error {
+	split := strings.Split(spec, "/")
+	if len(split) != 2 {
+		return fmt.Errorf("expected start/end")
+	}
+	start, _, err := parseDate(split[0], w.location)
+	if err != nil {
+		return fmt.Errorf("invalid start: %s", err)
+	}
+	end, dateOnly, err := parseDate(split[1], w.location)
+	if err != nil {
+		return fmt.Errorf("invalid end: %s", err)
+	}
+	if dateOnly {
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(start) {
+		return fmt.Errorf("end is not after start")
+	}
+	w.start, w.end = start, end
+	return nil
+}
+
+func parseDate(value string, location *time.Location) (time.Time, bool, error) {
+	for i, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, value, location)
+		if err == nil {
+			return t, i == 0, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("%q is not in YYYY-MM-DD[Thh:mm[:ss]] format", value)
+}
+
+func parseSchedule(fields []string) (*schedule, error) {
+	masks := make([]uint64, len(cronFields))
+	for i, field := range cronFields {
+		mask, err := field.parse(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		masks[i] = mask
+	}
+	// sunday is 0 and 7
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+	return &schedule{
+		minute:  masks[0],
+		hour:    masks[1],
+		dom:     masks[2],
+		month:   masks[3],
+		dow:     masks[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parse parses a comma separated list of values, ranges and steps like
+// `*/15`, `1-5` or `mon,fri`
+func (f *cronField) parse(spec string) (uint64, error) {
+	mask := uint64(0)
+	for _, item := range strings.Split(spec, ",") {
+		step := 1
+		if split := strings.SplitN(item, "/", 2); len(split) == 2 {
+			var err error
+			step, err = strconv.Atoi(split[1])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", split[1], f.name)
+			}
+			item = split[0]
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			split := strings.SplitN(item, "-", 2)
+			var err error
+			low, err = f.value(split[0])
+			if err != nil {
+				return 0, err
+			}
+			high, err = f.value(split[1])
+			if err != nil {
+				return 0, err
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range %q in %s field", item, f.name)
+			}
+		default:
+			var err error
+			low, err = f.value(item)
+			if err != nil {
+				return 0, err
+			}
+			// a single value with step runs to the maximum like in cron
+			if step == 1 {
+				high = low
+			}
+		}
+
+		for value := low; value <= high; value += step {
+			mask |= 1 << uint(value)
+		}
+	}
+	return mask, nil
+}
+
+func (f *cronField) value(value string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(value, name) {
+			return i, nil
+		}
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < f.min || parsed > f.max {
+		return 0, fmt.Errorf("invalid value %q in %s field, allowed are %d-%d", value, f.name, f.min, f.max)
+	}
+	return parsed, nil
+}
+
+// matches reports if the minute of t is part of the schedule, day of month
+// and day of week are combined like in cron
+func (s *schedule) matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// WithOverride allows deployments inside of freeze windows
+func WithOverride(override bool) CheckerOption {
+	return func(c *Checker) {
+		c.Override = override
+	}
+}
+
+// WithClock replaces the current time, mainly used for testing
+func WithClock(now func() time.Time) CheckerOption {
+	return func(c *Checker) {
+		c.now = now
+	}
+}
+
+func NewChecker(windows []*Window, options ...CheckerOption) *Checker {
+	c := &Checker{
+		Windows: windows,
+		now:     time.Now,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Check returns a FrozenError if the current time is inside of a freeze
+// window and the freeze is not overridden
+func (c *Checker) Check() error {
+	now := c.now()
+	window := c.active(now)
+	if window == nil {
+		return nil
+	}
+	if c.Override {
+		log.Printf("freeze window %q is active, deploying anyway because of freeze_override", window.Spec)
+		return nil
+	}
+	return &FrozenError{Window: window, Now: now, Until: c.until(now)}
+}
+
+// active returns the first window containing t
+func (c *Checker) active(t time.Time) *Window {
+	for _, window := range c.Windows {
+		if window.Contains(t) {
+			return window
+		}
+	}
+	return nil
+}
+
+// until returns the first minute after t outside of all windows, zero if
+// the freeze lasts longer than a year
+func (c *Checker) until(t time.Time) time.Time {
+	limit := t.AddDate(1, 0, 0)
+	for t.Before(limit) {
+		window := c.active(t)
+		if window == nil {
+			return t
+		}
+		if window.schedule == nil {
+			t = window.end
+		} else {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,166 @@
+package freeze
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		specs []string
+		err   error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "newlines and semicolons",
+			spec:  "* * * * sat,sun Europe/Berlin\n2026-12-24/2027-01-01; * 18-23 * * fri\n",
+			specs: []string{"* * * * sat,sun Europe/Berlin", "2026-12-24/2027-01-01", "* 18-23 * * fri"},
+		},
+		{
+			name:  "yaml list",
+			spec:  `["* * * * 6,0", "2026-12-24T12:00/2026-12-27 America/New_York"]`,
+			specs: []string{"* * * * 6,0", "2026-12-24T12:00/2026-12-27 America/New_York"},
+		},
+		{
+			name: "invalid time zone",
+			spec: "* * * * sat Mars/Olympus",
+			err:  fmt.Errorf("invalid time zone in freeze window \"* * * * sat Mars/Olympus\": unknown time zone Mars/Olympus"),
+		},
+		{
+			name: "invalid cron value",
+			spec: "* 24 * * *",
+			err:  fmt.Errorf("invalid freeze window \"* 24 * * *\": invalid value \"24\" in hour field, allowed are 0-23"),
+		},
+		{
+			name: "invalid range",
+			spec: "2027-01-01/2026-12-24",
+			err:  fmt.Errorf("invalid freeze window \"2027-01-01/2026-12-24\": end is not after start"),
+		},
+		{
+			name: "invalid date",
+			spec: "24.12.2026/2027-01-01",
+			err:  fmt.Errorf("invalid freeze window \"24.12.2026/2027-01-01\": invalid start: \"24.12.2026\" is not in YYYY-MM-DD[Thh:mm[:ss]] format"),
+		},
+		{
+			name: "wrong number of fields",
+			spec: "* * * sat",
+			err:  fmt.Errorf("invalid freeze window \"* * * sat\": expected a start/end date range or five cron fields"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		windows, err := Parse(test.spec)
+		if !errEq(err, test.err) {
+			t.Fatalf("unable to parse freeze windows:\n- %v\n+ %v", test.err, err)
+		} else if err != nil {
+			continue
+		}
+		specs := []string{}
+		for _, window := range windows {
+			specs = append(specs, window.Spec)
+		}
+		if fmt.Sprint(specs) != fmt.Sprint(test.specs) {
+			t.Fatalf("unexpected windows:\n- %q\n+ %q", test.specs, specs)
+		}
+	}
+}
+
+func TestChecker(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("unable to load time zone: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		windows  string
+		override bool
+		now      time.Time
+		err      error
+	}{
+		{
+			name: "no windows",
+			now:  time.Date(2026, 12, 26, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "weekday outside of weekend freeze",
+			windows: "* * * * sat,sun Europe/Berlin",
+			now:     time.Date(2026, 10, 16, 21, 59, 0, 0, time.UTC), // friday 23:59 in berlin
+		},
+		{
+			name:    "weekend freeze in local time zone",
+			windows: "* * * * sat,sun Europe/Berlin",
+			now:     time.Date(2026, 10, 16, 22, 30, 0, 0, time.UTC), // saturday 00:30 in berlin
+			err:     fmt.Errorf("deployments are frozen by window \"* * * * sat,sun Europe/Berlin\" until 2026-10-19 00:00 CEST, set freeze_override to deploy anyway"),
+		},
+		{
+			name:    "friday evening",
+			windows: "*/1 18-23 * * 5",
+			now:     time.Date(2026, 10, 16, 18, 15, 0, 0, time.UTC),
+			err:     fmt.Errorf("deployments are frozen by window \"*/1 18-23 * * 5\" until 2026-10-17 00:00 UTC, set freeze_override to deploy anyway"),
+		},
+		{
+			name:    "day of month or day of week",
+			windows: "* * 1 * mon",
+			now:     time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC), // monday 19th
+			err:     fmt.Errorf("deployments are frozen by window \"* * 1 * mon\" until 2026-10-20 00:00 UTC, set freeze_override to deploy anyway"),
+		},
+		{
+			name:    "holiday range includes the end date",
+			windows: "2026-12-24/2027-01-01 Europe/Berlin",
+			now:     time.Date(2027, 1, 1, 22, 0, 0, 0, berlin),
+			err:     fmt.Errorf("deployments are frozen by window \"2026-12-24/2027-01-01 Europe/Berlin\" until 2027-01-02 00:00 CET, set freeze_override to deploy anyway"),
+		},
+		{
+			name:    "after holiday range",
+			windows: "2026-12-24/2027-01-01 Europe/Berlin",
+			now:     time.Date(2027, 1, 2, 0, 0, 0, 0, berlin),
+		},
+		{
+			name:    "overlapping windows",
+			windows: "2026-12-24T12:00/2026-12-26T00:00;* * * * sat,sun",
+			now:     time.Date(2026, 12, 25, 9, 0, 0, 0, time.UTC), // friday
+			err:     fmt.Errorf("deployments are frozen by window \"2026-12-24T12:00/2026-12-26T00:00\" until 2026-12-28 00:00 UTC, set freeze_override to deploy anyway"),
+		},
+		{
+			name:     "override",
+			windows:  "* * * * *",
+			override: true,
+			now:      time.Date(2026, 12, 25, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "endless freeze",
+			windows: "* * * * *",
+			now:     time.Date(2026, 12, 25, 9, 0, 0, 0, time.UTC),
+			err:     fmt.Errorf("deployments are frozen by window \"* * * * *\" until further notice, set freeze_override to deploy anyway"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		windows, err := Parse(test.windows)
+		if err != nil {
+			t.Fatalf("unable to parse freeze windows: %s", err)
+		}
+		now := test.now
+		checker := NewChecker(
+			windows,
+			WithOverride(test.override),
+			WithClock(func() time.Time { return now }),
+		)
+		err = checker.Check()
+		if !errEq(err, test.err) {
+			t.Fatalf("unexpected check result:\n- %v\n+ %v", test.err, err)
+		}
+	}
+}
+
+func errEq(a error, b error) bool {
+	return fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b)
+}
@@ -0,0 +1,305 @@
+package helm
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/internal/redact"
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// Cache keeps repository indexes and chart dependencies between builds
+	Cache struct {
+		Dir     string
+		RepoTTL time.Duration
+	}
+
+	// chartLock is the subset of a Chart.lock required for caching
+	chartLock struct {
+		Digest string `json:"digest"`
+	}
+
+	// repoFile is the subset of the helm repositories.yaml the plugin
+	// writes, it is stored in the cache without credentials
+	repoFile struct {
+		APIVersion   string      `json:"apiVersion"`
+		Repositories []repoEntry `json:"repositories"`
+	}
+
+	// repoEntry is a repository of the helm repositories.yaml
+	repoEntry struct {
+		Name            string `json:"name"`
+		URL             string `json:"url"`
+		Username        string `json:"username,omitempty"`
+		Password        string `json:"password,omitempty"`
+		CAFile          string `json:"caFile,omitempty"`
+		Insecure        bool   `json:"insecure_skip_tls_verify,omitempty"`
+		PassCredentials bool   `json:"pass_credentials_all,omitempty"`
+	}
+)
+
+const (
+	cacheSumFile  = "charts.sha256"
+	cacheRepoFile = "repositories.yaml"
+)
+
+// WithCache skips repository adds and updates for indexes younger than
+// repoTTL and dependency builds if the dependencies in dir match the
+// Chart.lock
+func WithCache(dir string, repoTTL time.Duration) HelmOption {
+	return func(c *HelmCmd) error {
+		if dir != "" {
+			c.Cache = &Cache{Dir: dir, RepoTTL: repoTTL}
+		}
+		return nil
+	}
+}
+
+// wrap replaces repository adds, repository updates and dependency builds
+// with cache aware versions
+func (cache *Cache) wrap(h *HelmCmd, cmds []Command) []Command {
+	wrapped := make([]Command, len(cmds))
+	for i, cmd := range cmds {
+		cmd := cmd
+		switch cmd.Phase {
+		case PhaseRepoAdd:
+			repo, ok := h.repo(cmd.Args[3])
+			if !ok {
+				wrapped[i] = cmd
+				continue
+			}
+			wrapped[i] = Command{Phase: cmd.Phase, Args: cmd.Args, Func: func(ctx context.Context) error {
+				return cache.repoAdd(ctx, h, cmd, repo)
+			}}
+		case PhaseRepoUpdate:
+			wrapped[i] = Command{Phase: cmd.Phase, Args: cmd.Args, Func: func(ctx context.Context) error {
+				return cache.repoUpdate(ctx, h, cmd)
+			}}
+		case PhaseDependencyBuild:
+			wrapped[i] = Command{Phase: cmd.Phase, Args: cmd.Args, Func: func(ctx context.Context) error {
+				return cache.dependencyBuild(ctx, h, cmd)
+			}}
+		default:
+			wrapped[i] = cmd
+		}
+	}
+	return wrapped
+}
+
+// repoAdd registers the repository without contacting it if its index was
+// downloaded from the same url within the ttl. The credentials are only
+// written to the repositories.yaml of the build, never to the cache.
+func (cache *Cache) repoAdd(ctx context.Context, h *HelmCmd, cmd Command, repo HelmRepo) error {
+	cached := filepath.Join(cache.Dir, cacheRepoFile)
+	entry := repo.entry()
+	stripped := entry
+	stripped.Username, stripped.Password = "", ""
+	stripped.URL = redact.URL(stripped.URL)
+
+	known, err := loadRepoFile(cached)
+	if err != nil {
+		log.Printf("unable to read cached repositories: %s", err)
+		known = &repoFile{}
+	}
+	if previous, ok := known.get(repo.Name); ok && previous == stripped && cache.fresh(repo.Name) {
+		config, err := loadRepoFile(RepositoryConfig())
+		if err == nil {
+			config.set(entry)
+			err = config.save(RepositoryConfig())
+		}
+		if err == nil {
+			log.Printf("skipping repo add, index of %s is younger than %s", repo.Name, cache.RepoTTL)
+			return nil
+		}
+		log.Printf("unable to add repo %s from cache: %s", repo.Name, err)
+	}
+
+	err = h.run(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	known.set(stripped)
+	err = known.save(cached)
+	if err != nil {
+		log.Printf("unable to cache repo %s: %s", repo.Name, err)
+	}
+	return nil
+}
+
+// repoUpdate only updates the repositories with an index older than the ttl
+func (cache *Cache) repoUpdate(ctx context.Context, h *HelmCmd, cmd Command) error {
+	stale := []string{}
+	for _, repo := range h.Repos {
+		if !cache.fresh(repo.Name) {
+			stale = append(stale, repo.Name)
+		}
+	}
+	if len(stale) == 0 {
+		log.Printf("skipping repo update, all indexes are younger than %s", cache.RepoTTL)
+		return nil
+	}
+	cmd.Args = append(cmd.Args, stale...)
+	return h.run(ctx, Command{Phase: cmd.Phase, Args: cmd.Args})
+}
+
+// fresh reports if the index of the repository is younger than the ttl
+func (cache *Cache) fresh(name string) bool {
+	info, err := os.Stat(filepath.Join(RepositoryCache(), fmt.Sprintf("%s-index.yaml", name)))
+	return err == nil && time.Since(info.ModTime()) <= cache.RepoTTL
+}
+
+// dependencyBuild skips the build if the charts directory matches the
+// Chart.lock and restores or stores the dependencies in the cache otherwise
+func (cache *Cache) dependencyBuild(ctx context.Context, h *HelmCmd, cmd Command) error {
+	chart := cmd.Args[len(cmd.Args)-1]
+	data, err := ioutil.ReadFile(filepath.Join(chart, "Chart.lock"))
+	if err != nil {
+		log.Printf("unable to read Chart.lock, dependencies are not cached: %s", err)
+		return h.run(ctx, cmd)
+	}
+	lock := &chartLock{}
+	err = yaml.Unmarshal(data, lock)
+	if err != nil || lock.Digest == "" {
+		log.Printf("unable to parse Chart.lock, dependencies are not cached: %v", err)
+		return h.run(ctx, cmd)
+	}
+
+	charts := filepath.Join(chart, "charts")
+	cached := filepath.Join(cache.Dir, "dependencies", strings.Replace(lock.Digest, ":", "-", 1))
+	want, err := ioutil.ReadFile(filepath.Join(cached, cacheSumFile))
+	if err == nil {
+		if got, _ := archivesSum(charts); got == string(want) {
+			log.Printf("skipping dependency build, dependencies match %s", lock.Digest)
+			return nil
+		}
+		err = copyArchives(cached, charts)
+		if got, _ := archivesSum(charts); err == nil && got == string(want) {
+			log.Printf("skipping dependency build, restored dependencies for %s from cache", lock.Digest)
+			return nil
+		}
+	}
+
+	err = h.run(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	sum, err := archivesSum(charts)
+	if err == nil {
+		err = copyArchives(charts, cached)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(cached, cacheSumFile), []byte(sum), 0600)
+	}
+	if err != nil {
+		log.Printf("unable to cache dependencies: %s", err)
+	}
+	return nil
+}
+
+// archivesSum returns a checksum over the names and contents of all chart
+// archives in dir
+func archivesSum(dir string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tgz"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	hash := sha256.New()
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		_, _ = io.WriteString(hash, filepath.Base(file))
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// copyArchives copies all chart archives from src to dst
+func copyArchives(src, dst string) error {
+	files, err := filepath.Glob(filepath.Join(src, "*.tgz"))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(dst, filepath.Base(file)), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRepoFile reads a repositories.yaml, a missing file is empty
+func loadRepoFile(path string) (*repoFile, error) {
+	f := &repoFile{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", path, err)
+	}
+	return f, nil
+}
+
+// get returns the repository with the name
+func (f *repoFile) get(name string) (repoEntry, bool) {
+	for _, entry := range f.Repositories {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return repoEntry{}, false
+}
+
+// set adds or replaces the repository
+func (f *repoFile) set(entry repoEntry) {
+	for i := range f.Repositories {
+		if f.Repositories[i].Name == entry.Name {
+			f.Repositories[i] = entry
+			return
+		}
+	}
+	f.Repositories = append(f.Repositories, entry)
+}
+
+// save writes the repositories.yaml readable only by the owner, it may
+// contain credentials
+func (f *repoFile) save(path string) error {
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
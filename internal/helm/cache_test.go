@@ -0,0 +1,155 @@
+package helm
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-helm3")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	repoCache := filepath.Join(dir, "repository")
+	cacheDir := filepath.Join(dir, "cache")
+	chart := filepath.Join(dir, "chart")
+	for _, d := range []string{repoCache, cacheDir, chart} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatalf("unable to create dir: %s", err)
+		}
+	}
+	os.Setenv("HELM_REPOSITORY_CACHE", repoCache)
+	defer os.Unsetenv("HELM_REPOSITORY_CACHE")
+	// the helm configuration is not shared between builds
+	repoConfig := filepath.Join(dir, "config", "repositories.yaml")
+	os.Setenv("HELM_REPOSITORY_CONFIG", repoConfig)
+	defer os.Unsetenv("HELM_REPOSITORY_CONFIG")
+	newBuild := func() {
+		_ = os.RemoveAll(filepath.Dir(repoConfig))
+	}
+
+	err = ioutil.WriteFile(filepath.Join(repoCache, "fresh-index.yaml"), []byte("entries: {}\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write index: %s", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(chart, "Chart.lock"), []byte("digest: sha256:1234\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write Chart.lock: %s", err)
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	newCmd := func() *HelmCmd {
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithChart(chart),
+			WithHelmRepos([]HelmRepo{
+				{Name: "fresh", URL: "https://example.com/fresh", Username: "user", Password: "secret"},
+				{Name: "stale", URL: "https://example.com/stale"},
+			}),
+			WithBuildDependencies(true, chart),
+			WithCache(cacheDir, time.Hour),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		return cmd
+	}
+	expectAdd := func(name string, download bool) {
+		args := []interface{}{"repo", "add", name, "https://example.com/" + name}
+		// helm downloads the index while adding the repository
+		add := func(ctx context.Context, name string, args ...string) error {
+			if !download {
+				return nil
+			}
+			return ioutil.WriteFile(filepath.Join(repoCache, args[2]+"-index.yaml"), []byte("entries: {}\n"), 0600)
+		}
+		if name == "fresh" {
+			args = append(args, "--username", "user", "--password-stdin")
+			mockRunner.EXPECT().RunWithStdin(context.Background(), readerEq("secret"), "helm", args...).DoAndReturn(
+				func(ctx context.Context, stdin io.Reader, name string, args ...string) error {
+					return add(ctx, name, args...)
+				},
+			)
+			return
+		}
+		mockRunner.EXPECT().Run(context.Background(), "helm", args...).DoAndReturn(add)
+	}
+	expectUpgrade := func() {
+		mockRunner.EXPECT().Run(context.Background(), "helm", "upgrade", "--install", "foo", chart)
+	}
+
+	// first run adds the repositories and builds the dependencies
+	expectAdd("fresh", false)
+	expectAdd("stale", true)
+	mockRunner.EXPECT().Run(context.Background(), "helm", "dependency", "build", chart).DoAndReturn(
+		func(ctx context.Context, name string, args ...string) error {
+			_ = os.Mkdir(filepath.Join(chart, "charts"), 0700)
+			return ioutil.WriteFile(filepath.Join(chart, "charts", "dep-1.0.0.tgz"), []byte("dep"), 0600)
+		},
+	)
+	expectUpgrade()
+	if err := newCmd().Run(context.Background()); err != nil {
+		t.Fatalf("unable to run helm cmd: %s", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cacheDir, cacheRepoFile))
+	if err != nil || strings.Contains(string(data), "secret") || strings.Contains(string(data), "user") {
+		t.Fatalf("repositories not cached without credentials: %v\n%s", err, data)
+	}
+
+	// second run neither adds nor updates the repositories and skips the build
+	newBuild()
+	expectUpgrade()
+	if err := newCmd().Run(context.Background()); err != nil {
+		t.Fatalf("unable to run helm cmd: %s", err)
+	}
+	config, err := loadRepoFile(repoConfig)
+	if err != nil {
+		t.Fatalf("unable to read repositories.yaml: %s", err)
+	}
+	want := []repoEntry{
+		{Name: "fresh", URL: "https://example.com/fresh", Username: "user", Password: "secret"},
+		{Name: "stale", URL: "https://example.com/stale"},
+	}
+	if diff := cmp.Diff(want, config.Repositories); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	// third run restores the dependencies from the cache and updates the
+	// expired index
+	err = os.RemoveAll(filepath.Join(chart, "charts"))
+	if err != nil {
+		t.Fatalf("unable to remove charts: %s", err)
+	}
+	expired := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(repoCache, "stale-index.yaml"), expired, expired)
+	if err != nil {
+		t.Fatalf("unable to expire index: %s", err)
+	}
+	newBuild()
+	expectAdd("stale", false)
+	mockRunner.EXPECT().Run(context.Background(), "helm", "repo", "update", "stale")
+	expectUpgrade()
+	if err := newCmd().Run(context.Background()); err != nil {
+		t.Fatalf("unable to run helm cmd: %s", err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(chart, "charts", "dep-1.0.0.tgz"))
+	if err != nil || string(data) != "dep" {
+		t.Fatalf("dependency not restored: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/internal/core"
+)
+
+const (
+	// CancelCleanupNone leaves the release as it is after a cancellation
+	CancelCleanupNone = "none"
+
+	// CancelCleanupRollback restores the release to the state before the
+	// upgrade after a cancellation
+	CancelCleanupRollback = "rollback"
+
+	defaultCancelTimeout = 5 * time.Minute
+)
+
+// WithCancelCleanup sets the cleanup after a cancelled run, it is limited by
+// timeout since the context of the run is already cancelled
+func WithCancelCleanup(cleanup string, timeout time.Duration) HelmOption {
+	return func(c *HelmCmd) error {
+		switch cleanup {
+		case "", CancelCleanupNone, CancelCleanupRollback:
+		default:
+			return fmt.Errorf("unknown cancel cleanup %q, allowed are %s and %s", cleanup, CancelCleanupNone, CancelCleanupRollback)
+		}
+		c.CancelCleanup = cleanup
+		c.CancelTimeout = timeout
+		return nil
+	}
+}
+
+// cleanupContext returns a context for work after the run was cancelled
+func (h *HelmCmd) cleanupContext() (context.Context, context.CancelFunc) {
+	timeout := h.CancelTimeout
+	if timeout <= 0 {
+		timeout = defaultCancelTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// cancelled runs the configured cleanup after the run was cancelled during
+// or after the upgrade
+func (h *HelmCmd) cancelled(target *rollbackTarget, err error) error {
+	log.Printf("CANCELLED: %s", err)
+	if h.CancelCleanup != CancelCleanupRollback || target == nil {
+		return Wrap(err, "cancelled", core.CancelledErrorKind)
+	}
+	if h.lockLost() != nil {
+		// another build holds the release now
+		return Wrap(err, "cancelled", core.CancelledErrorKind)
+	}
+	ctx, cancel := h.cleanupContext()
+	defer cancel()
+	action, restoreErr := h.restore(ctx, target)
+	if restoreErr != nil {
+		log.Printf("%s FAILED: %s", action, restoreErr)
+		wrapped := Wrap(restoreErr, fmt.Sprintf("cancelled and %s failed", action), core.CancelledErrorKind)
+		h.fireRollback(ctx, restoreErr, wrapped)
+		return wrapped
+	}
+	log.Printf("%s SUCCESSFUL", action)
+	wrapped := Wrap(err, fmt.Sprintf("cancelled and %s successful", action), core.CancelledErrorKind)
+	h.fireRollback(ctx, nil, wrapped)
+	return wrapped
+}
@@ -0,0 +1,179 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCancel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	tests := []struct {
+		name    string
+		cleanup string
+		setup   func()
+		runErr  error
+		hooks   []string
+	}{
+		{
+			name:    "no cleanup",
+			cleanup: CancelCleanupNone,
+			setup:   func() {},
+			runErr:  fmt.Errorf("cancelled: helm failed: signal: terminated"),
+		},
+		{
+			name:    "rollback",
+			cleanup: CancelCleanupRollback,
+			setup: func() {
+				mockRunner.EXPECT().Output(
+					gomock.Any(),
+					"helm", "list", "--all", "--filter", "^foo$", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+				).Return([]byte(`[{"revision": 2, "status": "deployed"}]`), nil)
+				mockRunner.EXPECT().Output(
+					gomock.Any(),
+					"helm", "history", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+				).Return([]byte(`[{"revision": 2, "status": "deployed"}]`), nil)
+				mockRunner.EXPECT().Run(
+					gomock.Any(),
+					"helm", "rollback", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "2",
+				).Do(func(ctx context.Context, _ string, _ ...string) {
+					if ctx.Err() != nil {
+						t.Fatalf("rollback with expired context: %s", ctx.Err())
+					}
+				})
+				mockRunner.EXPECT().Output(
+					gomock.Any(),
+					"helm", "status", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+				).Return([]byte(`{"version": 2}`), nil)
+			},
+			runErr: fmt.Errorf("cancelled and rollback successful: helm failed: signal: terminated"),
+			hooks:  []string{"rollback cancelled 2"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		var hooks []string
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			WithCancelCleanup(test.cleanup, 0),
+			WithOnRollback(func(ctx context.Context, outcome *Outcome) error {
+				if ctx.Err() != nil {
+					t.Fatalf("hook with expired context: %s", ctx.Err())
+				}
+				hooks = append(hooks, fmt.Sprintf("rollback %s %d", outcome.Kind(), outcome.Revision))
+				return nil
+			}),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		test.setup()
+		mockRunner.EXPECT().Run(
+			gomock.Any(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		).DoAndReturn(func(context.Context, string, ...string) error {
+			// SIGTERM received while helm is running
+			cancel()
+			return fmt.Errorf("signal: terminated")
+		})
+		err = cmd.Run(ctx)
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+		if err.(*HelmError).Kind != "cancelled" {
+			t.Fatalf("unexpected kind %s", err.(*HelmError).Kind)
+		}
+		if diff := cmp.Diff(test.hooks, hooks); diff != "" {
+			t.Fatalf("unexpected hooks:\n%s", diff)
+		}
+	}
+
+	_, err := NewHelmCmd(WithInstallUpgradeMode(), WithRelease("foo"), WithChart("chart"), WithCancelCleanup("retry", 0))
+	if !errEq(err, fmt.Errorf(`unable to parse option: unknown cancel cleanup "retry", allowed are none and rollback`)) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCancelBeforeUpgrade(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	conn := []interface{}{"-n", "foo", "--kubeconfig", "/root/.kube/config"}
+	tests := []struct {
+		name    string
+		option  HelmOption
+		command []interface{}
+		runErr  error
+	}{
+		{
+			name:    "waiting for the lock",
+			option:  WithLock(Lock{Enabled: true, Holder: "https://drone/me/2"}),
+			command: append([]interface{}{"kubectl", "get", "lease", "drone-helm3-foo", "-o", "json"}, conn...),
+			runErr:  fmt.Errorf("cancelled: unable to get lease: signal: terminated"),
+		},
+		{
+			name:    "recovering a pending release",
+			option:  WithRecoverPending(true),
+			command: append(append([]interface{}{"helm", "status", "foo"}, conn...), "-o", "json"),
+			runErr:  fmt.Errorf("cancelled: unable to get release status: signal: terminated"),
+		},
+		{
+			name:    "rendering the manifest",
+			option:  WithManifestChecks(ManifestChecks{Rules: map[string]Severity{"latest-tag": SeverityDeny}}),
+			command: append(append([]interface{}{"helm", "upgrade", "--install"}, conn...), "--dry-run", "--output", "json", "foo", "chart"),
+			runErr:  fmt.Errorf("cancelled: unable to render manifest: signal: terminated"),
+		},
+		{
+			name:    "finding the rollback target",
+			option:  WithRollbackOnFailure(true),
+			command: append(append([]interface{}{"helm", "list", "--all", "--filter", "^foo$"}, conn...), "-o", "json"),
+			runErr:  fmt.Errorf("cancelled: unable to list releases: signal: terminated"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			test.option,
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		mockRunner.EXPECT().Output(gomock.Any(), test.command[0], test.command[1:]...).DoAndReturn(
+			func(context.Context, string, ...string) ([]byte, error) {
+				// SIGTERM received while the command is running
+				cancel()
+				return nil, fmt.Errorf("signal: terminated")
+			},
+		)
+		err = cmd.Run(ctx)
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+		if err.(*HelmError).Kind != "cancelled" {
+			t.Fatalf("unexpected kind %s", err.(*HelmError).Kind)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// ManifestChecks configures the checks of the rendered manifest before
+	// the upgrade
+	ManifestChecks struct {
+		// Rules maps the names of the enabled rules to their severity
+		Rules map[string]Severity
+
+		// RequiredLabels are the labels every resource needs for the
+		// required-labels rule
+		RequiredLabels []string
+	}
+
+	// Severity decides if a finding only warns or denies the deployment
+	Severity = string
+
+	// manifestRule returns the violations of a resource
+	manifestRule func(resource manifestResource, checks *ManifestChecks) []string
+
+	// manifestFinding is a violation of a rule by a resource
+	manifestFinding struct {
+		Rule     string
+		Severity Severity
+		Resource manifestResource
+		Message  string
+		Exempt   bool
+	}
+
+	// renderedRelease is the subset of the release printed by a dry run
+	renderedRelease struct {
+		Manifest string `json:"manifest"`
+		Hooks    []struct {
+			Manifest string `json:"manifest"`
+		} `json:"hooks"`
+	}
+)
+
+const (
+	SeverityWarn Severity = "warn"
+	SeverityDeny Severity = "deny"
+	SeverityOff  Severity = "off"
+
+	// PhaseRender renders the manifest for the checks
+	PhaseRender Phase = "render"
+
+	// checkExemptAnnotation lists the rules a resource is exempt from,
+	// comma separated or `*` for all rules
+	checkExemptAnnotation = "drone-helm3/skip-checks"
+)
+
+// manifestRules are the available rules by name
+var manifestRules = map[string]manifestRule{
+	"latest-tag":      checkLatestTag,
+	"resources":       checkResources,
+	"privileged":      checkPrivileged,
+	"host-path":       checkHostPath,
+	"required-labels": checkRequiredLabels,
+}
+
+// ParseManifestChecks parses the severity per rule, either a YAML/JSON
+// object or comma separated rule=severity pairs
+func ParseManifestChecks(spec string) (map[string]Severity, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	raw := map[string]string{}
+	if strings.HasPrefix(spec, "{") || strings.Contains(spec, ":") {
+		err := yaml.Unmarshal([]byte(spec), &raw)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse manifest checks: %s", err)
+		}
+	} else {
+		for _, pair := range strings.Split(spec, ",") {
+			split := strings.SplitN(pair, "=", 2)
+			if len(split) != 2 {
+				return nil, fmt.Errorf("not in rule=severity format: %s", pair)
+			}
+			raw[strings.TrimSpace(split[0])] = strings.TrimSpace(split[1])
+		}
+	}
+
+	rules := map[string]Severity{}
+	for rule, severity := range raw {
+		if _, ok := manifestRules[rule]; !ok {
+			return nil, fmt.Errorf("unknown rule %q, allowed are %s", rule, strings.Join(ruleNames(), ", "))
+		}
+		switch severity {
+		case SeverityWarn, SeverityDeny:
+			rules[rule] = severity
+		case SeverityOff:
+		default:
+			return nil, fmt.Errorf("invalid severity %q of rule %s, allowed are warn, deny and off", severity, rule)
+		}
+	}
+	return rules, nil
+}
+
+func ruleNames() []string {
+	names := []string{}
+	for name := range manifestRules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithManifestChecks checks the rendered manifest before the upgrade
+func WithManifestChecks(checks ManifestChecks) HelmOption {
+	return func(c *HelmCmd) error {
+		if _, ok := checks.Rules["required-labels"]; ok && len(checks.RequiredLabels) == 0 {
+			return fmt.Errorf("rule required-labels needs required labels")
+		}
+		c.ManifestChecks = checks
+		return nil
+	}
+}
+
+// renderManifest returns the resources and hooks of a dry run upgrade with
+// the arguments of the upgrade, including post renderers
+func (h *HelmCmd) renderManifest(ctx context.Context, args []string) ([]manifestResource, error) {
+	// release and chart are always the last arguments
+	n := len(args) - 2
+	dryRun := append(append(append([]string{}, args[:n]...), "--dry-run", "--output", "json"), args[n:]...)
+
+	var out []byte
+	err := h.run(ctx, Command{Phase: PhaseRender, Args: append([]string{"helm"}, dryRun...), Func: func(ctx context.Context) error {
+		return h.retry(ctx, PhaseRender, func() error {
+			var err error
+			out, err = h.Runner.Output(ctx, "helm", dryRun...)
+			return err
+		})
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("unable to render manifest: %s", err)
+	}
+
+	release := &renderedRelease{}
+	err = json.Unmarshal(out, release)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse rendered release: %s", err)
+	}
+	manifest := release.Manifest
+	for _, hook := range release.Hooks {
+		manifest += "\n---\n" + hook.Manifest
+	}
+	return parseManifest([]byte(manifest))
+}
+
+// check runs the enabled rules on the resources
+func (c *ManifestChecks) check(resources []manifestResource) []manifestFinding {
+	findings := []manifestFinding{}
+	for _, resource := range resources {
+		exempt := exemptRules(resource)
+		for _, rule := range ruleNames() {
+			severity, ok := c.Rules[rule]
+			if !ok {
+				continue
+			}
+			for _, message := range manifestRules[rule](resource, c) {
+				findings = append(findings, manifestFinding{
+					Rule:     rule,
+					Severity: severity,
+					Resource: resource,
+					Message:  message,
+					Exempt:   exempt["*"] || exempt[rule],
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// enforce logs the findings of the resources, the error lists the denied
+// findings
+func (c *ManifestChecks) enforce(resources []manifestResource) error {
+	findings := c.check(resources)
+	logFindings(findings)
+	denied := []string{}
+	for _, finding := range findings {
+		if finding.Severity == SeverityDeny && !finding.Exempt {
+			denied = append(denied, fmt.Sprintf("%s %s", finding.Rule, resourceRef(finding.Resource)))
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("%d denied findings: %s", len(denied), strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// exemptRules returns the rules listed in the exempt annotation
+func exemptRules(resource manifestResource) map[string]bool {
+	exempt := map[string]bool{}
+	annotations, _ := nested(resource.Object, "metadata", "annotations").(map[string]interface{})
+	value, _ := annotations[checkExemptAnnotation].(string)
+	for _, rule := range strings.Split(value, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			exempt[rule] = true
+		}
+	}
+	return exempt
+}
+
+// logFindings logs the findings as table
+func logFindings(findings []manifestFinding) {
+	if len(findings) == 0 {
+		log.Printf("manifest checks passed")
+		return
+	}
+	denied, warned, exempted := 0, 0, 0
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEVERITY\tRULE\tRESOURCE\tMESSAGE")
+	for _, finding := range findings {
+		severity := finding.Severity
+		switch {
+		case finding.Exempt:
+			severity = "exempt"
+			exempted++
+		case severity == SeverityDeny:
+			denied++
+		default:
+			warned++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", severity, finding.Rule, resourceRef(finding.Resource), finding.Message)
+	}
+	_ = w.Flush()
+	log.Printf("manifest checks: %d denied, %d warnings, %d exempt\n%s", denied, warned, exempted, buf)
+}
+
+func resourceRef(resource manifestResource) string {
+	return fmt.Sprintf("%s/%s", strings.ToLower(resource.Kind), resource.Name)
+}
+
+// nested returns the value at the path of maps, nil if it does not exist
+func nested(object interface{}, path ...string) interface{} {
+	for _, key := range path {
+		m, ok := object.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		object = m[key]
+	}
+	return object
+}
+
+// podSpec returns the pod spec of pods and workloads, nil for other kinds
+func podSpec(resource manifestResource) map[string]interface{} {
+	var spec interface{}
+	switch resource.Kind {
+	case "Pod":
+		spec = nested(resource.Object, "spec")
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		spec = nested(resource.Object, "spec", "template", "spec")
+	case "CronJob":
+		spec = nested(resource.Object, "spec", "jobTemplate", "spec", "template", "spec")
+	}
+	m, _ := spec.(map[string]interface{})
+	return m
+}
+
+// containers returns all containers of the pod spec of the resource
+func containers(resource manifestResource) []map[string]interface{} {
+	spec := podSpec(resource)
+	all := []map[string]interface{}{}
+	for _, key := range []string{"initContainers", "containers", "ephemeralContainers"} {
+		list, _ := spec[key].([]interface{})
+		for _, item := range list {
+			if container, ok := item.(map[string]interface{}); ok {
+				all = append(all, container)
+			}
+		}
+	}
+	return all
+}
+
+// checkLatestTag denies images with the latest tag or without tag and
+// digest
+func checkLatestTag(resource manifestResource, _ *ManifestChecks) []string {
+	messages := []string{}
+	for _, container := range containers(resource) {
+		image, _ := container["image"].(string)
+		if strings.Contains(image, "@") {
+			continue
+		}
+		name := image[strings.LastIndex(image, "/")+1:]
+		tag := ""
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			tag = name[i+1:]
+		}
+		if tag == "" || tag == "latest" {
+			messages = append(messages, fmt.Sprintf("container %s uses image %q without fixed tag", container["name"], image))
+		}
+	}
+	return messages
+}
+
+// checkResources requires resource requests and limits for all containers
+func checkResources(resource manifestResource, _ *ManifestChecks) []string {
+	messages := []string{}
+	for _, container := range containers(resource) {
+		missing := []string{}
+		for _, key := range []string{"requests", "limits"} {
+			values, _ := nested(container, "resources", key).(map[string]interface{})
+			if len(values) == 0 {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > 0 {
+			messages = append(messages, fmt.Sprintf("container %s has no resource %s", container["name"], strings.Join(missing, " and ")))
+		}
+	}
+	return messages
+}
+
+// checkPrivileged denies privileged containers
+func checkPrivileged(resource manifestResource, _ *ManifestChecks) []string {
+	messages := []string{}
+	for _, container := range containers(resource) {
+		if privileged, _ := nested(container, "securityContext", "privileged").(bool); privileged {
+			messages = append(messages, fmt.Sprintf("container %s is privileged", container["name"]))
+		}
+	}
+	return messages
+}
+
+// checkHostPath denies hostPath volumes
+func checkHostPath(resource manifestResource, _ *ManifestChecks) []string {
+	messages := []string{}
+	volumes, _ := podSpec(resource)["volumes"].([]interface{})
+	for _, item := range volumes {
+		volume, _ := item.(map[string]interface{})
+		if hostPath, ok := volume["hostPath"]; ok {
+			messages = append(messages, fmt.Sprintf("volume %s mounts host path %v", volume["name"], nested(hostPath, "path")))
+		}
+	}
+	return messages
+}
+
+// checkRequiredLabels requires the labels on every resource
+func checkRequiredLabels(resource manifestResource, checks *ManifestChecks) []string {
+	labels, _ := nested(resource.Object, "metadata", "labels").(map[string]interface{})
+	missing := []string{}
+	for _, label := range checks.RequiredLabels {
+		if _, ok := labels[label]; !ok {
+			missing = append(missing, label)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("missing labels %s", strings.Join(missing, ", "))}
+}
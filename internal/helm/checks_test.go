@@ -0,0 +1,238 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+const checksManifest = `---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app.kubernetes.io/name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: migrate
+          image: registry.example.com/app@sha256:1234
+          resources:
+            requests: {cpu: 10m}
+            limits: {memory: 64Mi}
+      containers:
+        - name: app
+          image: registry.example.com:5000/app
+          resources:
+            requests: {cpu: 10m}
+          securityContext:
+            privileged: true
+---
+# Source: app/templates/daemonset.yaml
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+  annotations:
+    drone-helm3/skip-checks: host-path, privileged
+spec:
+  template:
+    spec:
+      containers:
+        - name: agent
+          image: agent:1.2.3
+          resources:
+            requests: {cpu: 10m}
+            limits: {memory: 64Mi}
+          securityContext:
+            privileged: true
+      volumes:
+        - name: proc
+          hostPath:
+            path: /proc
+---
+# Source: app/templates/cronjob.yaml
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: cleanup
+  annotations:
+    drone-helm3/skip-checks: "*"
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: cleanup
+              image: busybox:latest
+`
+
+func TestParseManifestChecks(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		rules map[string]Severity
+		err   error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "pairs",
+			spec:  "latest-tag=deny, resources=warn, privileged=off",
+			rules: map[string]Severity{"latest-tag": SeverityDeny, "resources": SeverityWarn},
+		},
+		{
+			name:  "json",
+			spec:  `{"host-path": "deny", "required-labels": "warn"}`,
+			rules: map[string]Severity{"host-path": SeverityDeny, "required-labels": SeverityWarn},
+		},
+		{
+			name: "unknown rule",
+			spec: "latest=deny",
+			err:  fmt.Errorf("unknown rule \"latest\", allowed are host-path, latest-tag, privileged, required-labels, resources"),
+		},
+		{
+			name: "invalid severity",
+			spec: "latest-tag=error",
+			err:  fmt.Errorf("invalid severity \"error\" of rule latest-tag, allowed are warn, deny and off"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		rules, err := ParseManifestChecks(test.spec)
+		if !errEq(err, test.err) {
+			t.Fatalf("unable to parse manifest checks:\n- %v\n+ %v", test.err, err)
+		} else if err != nil {
+			continue
+		}
+		if diff := cmp.Diff(test.rules, rules); diff != "" {
+			t.Fatalf("unexpected rules:\n%s", diff)
+		}
+	}
+}
+
+func TestManifestChecks(t *testing.T) {
+	resources, err := parseManifest([]byte(checksManifest))
+	if err != nil {
+		t.Fatalf("unable to parse manifest: %s", err)
+	}
+	checks := &ManifestChecks{
+		Rules: map[string]Severity{
+			"latest-tag":      SeverityDeny,
+			"resources":       SeverityWarn,
+			"privileged":      SeverityDeny,
+			"host-path":       SeverityDeny,
+			"required-labels": SeverityWarn,
+		},
+		RequiredLabels: []string{"app.kubernetes.io/name"},
+	}
+
+	type finding struct {
+		Rule, Severity, Resource, Message string
+		Exempt                            bool
+	}
+	want := []finding{
+		{"latest-tag", SeverityDeny, "deployment/app", `container app uses image "registry.example.com:5000/app" without fixed tag`, false},
+		{"privileged", SeverityDeny, "deployment/app", "container app is privileged", false},
+		{"resources", SeverityWarn, "deployment/app", "container app has no resource limits", false},
+		{"host-path", SeverityDeny, "daemonset/agent", "volume proc mounts host path /proc", true},
+		{"privileged", SeverityDeny, "daemonset/agent", "container agent is privileged", true},
+		{"required-labels", SeverityWarn, "daemonset/agent", "missing labels app.kubernetes.io/name", false},
+		{"latest-tag", SeverityDeny, "cronjob/cleanup", `container cleanup uses image "busybox:latest" without fixed tag`, true},
+		{"required-labels", SeverityWarn, "cronjob/cleanup", "missing labels app.kubernetes.io/name", true},
+		{"resources", SeverityWarn, "cronjob/cleanup", "container cleanup has no resource requests and limits", true},
+	}
+	got := []finding{}
+	for _, f := range checks.check(resources) {
+		got = append(got, finding{f.Rule, f.Severity, resourceRef(f.Resource), f.Message, f.Exempt})
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected findings:\n%s", diff)
+	}
+
+	err = checks.enforce(resources)
+	wantErr := fmt.Errorf("2 denied findings: latest-tag deployment/app, privileged deployment/app")
+	if !errEq(err, wantErr) {
+		t.Fatalf("unexpected result:\n- %v\n+ %v", wantErr, err)
+	}
+}
+
+func TestRunManifestChecks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	release := func(manifest string) []byte {
+		out, _ := json.Marshal(map[string]interface{}{
+			"name":     "foo",
+			"manifest": manifest,
+			"hooks":    []map[string]string{{"manifest": "apiVersion: v1\nkind: Pod\nmetadata:\n  name: test\nspec:\n  containers:\n    - name: test\n      image: busybox:1.36\n"}},
+		})
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		rendered  []byte
+		renderErr error
+		upgrade   bool
+		runErr    error
+	}{
+		{
+			name:     "passed",
+			rendered: release("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n"),
+			upgrade:  true,
+		},
+		{
+			name:     "denied",
+			rendered: release(checksManifest),
+			runErr:   fmt.Errorf("manifest checks failed: 1 denied findings: latest-tag deployment/app"),
+		},
+		{
+			name:      "render failed",
+			renderErr: fmt.Errorf("exit status 1"),
+			runErr:    fmt.Errorf("unable to check manifest: unable to render manifest: exit status 1"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			WithManifestChecks(ManifestChecks{Rules: map[string]Severity{"latest-tag": SeverityDeny}}),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "--dry-run", "--output", "json", "foo", "chart",
+		).Return(test.rendered, test.renderErr)
+		if test.upgrade {
+			mockRunner.EXPECT().Run(
+				context.Background(),
+				"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+			)
+		}
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type (
+	// Diagnostics configures the collection of cluster state after a failed
+	// deployment
+	Diagnostics struct {
+		Enabled  bool
+		File     string
+		LogLines int
+	}
+
+	eventList struct {
+		Items []struct {
+			Type           string `json:"type"`
+			Reason         string `json:"reason"`
+			Message        string `json:"message"`
+			Count          int    `json:"count"`
+			LastTimestamp  string `json:"lastTimestamp"`
+			InvolvedObject struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"involvedObject"`
+		} `json:"items"`
+	}
+
+	podList struct {
+		Items []pod `json:"items"`
+	}
+
+	pod struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Status struct {
+			Phase      string `json:"phase"`
+			Reason     string `json:"reason"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+			InitContainerStatuses []containerStatus `json:"initContainerStatuses"`
+			ContainerStatuses     []containerStatus `json:"containerStatuses"`
+		} `json:"status"`
+	}
+
+	containerStatus struct {
+		Name         string         `json:"name"`
+		Ready        bool           `json:"ready"`
+		RestartCount int            `json:"restartCount"`
+		State        containerState `json:"state"`
+		LastState    containerState `json:"lastState"`
+	}
+
+	containerState struct {
+		Waiting *struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"waiting"`
+		Terminated *struct {
+			Reason   string `json:"reason"`
+			ExitCode int    `json:"exitCode"`
+		} `json:"terminated"`
+	}
+
+	// podSelector selects the pods of a workload
+	podSelector struct {
+		Namespace string
+		Selector  string
+	}
+)
+
+// summaryEvents is the number of warning events in the logged summary
+const summaryEvents = 10
+
+// WithDiagnostics collects events, pod states and logs of crashing containers
+// if the deployment fails
+func WithDiagnostics(diagnostics Diagnostics) HelmOption {
+	return func(c *HelmCmd) error {
+		c.Diagnostics = diagnostics
+		return nil
+	}
+}
+
+// ready reports if the pod is ready or completed
+func (p *pod) ready() bool {
+	if p.Status.Phase == "Succeeded" {
+		return true
+	}
+	for _, condition := range p.Status.Conditions {
+		if condition.Type == "Ready" {
+			return condition.Status == "True"
+		}
+	}
+	return false
+}
+
+// String describes the state of the container
+func (s containerState) String() string {
+	switch {
+	case s.Waiting != nil:
+		if s.Waiting.Message != "" {
+			return fmt.Sprintf("waiting: %s (%s)", s.Waiting.Reason, s.Waiting.Message)
+		}
+		return fmt.Sprintf("waiting: %s", s.Waiting.Reason)
+	case s.Terminated != nil:
+		return fmt.Sprintf("terminated: %s (exit code %d)", s.Terminated.Reason, s.Terminated.ExitCode)
+	}
+	return "running"
+}
+
+// crashing reports if the container has restarted or terminated with an
+// error
+func (s *containerStatus) crashing() bool {
+	if s.RestartCount > 0 {
+		return true
+	}
+	if s.State.Waiting != nil && s.State.Waiting.Reason == "CrashLoopBackOff" {
+		return true
+	}
+	return s.State.Terminated != nil && s.State.Terminated.ExitCode != 0
+}
+
+// diagnose collects the diagnostics of the release, logs a summary and
+// writes the full bundle to the diagnostics file. Errors are only logged,
+// the diagnostics must not hide the failure of the deployment.
+func (h *HelmCmd) diagnose(ctx context.Context) {
+	summary := &bytes.Buffer{}
+	bundle := &bytes.Buffer{}
+
+	resources, err := h.manifest(ctx)
+	if err != nil {
+		log.Printf("unable to get release manifest, selecting pods by label: %s", err)
+	}
+	pods, err := h.releasePods(ctx, resources)
+	if err != nil {
+		log.Printf("unable to collect pods: %s", err)
+	}
+	err = h.diagnoseEvents(ctx, summary, bundle, resources, pods)
+	if err != nil {
+		log.Printf("unable to collect events: %s", err)
+	}
+	h.diagnosePods(ctx, summary, bundle, pods)
+
+	log.Printf("diagnostics of release %s:\n%s", h.Release, summary)
+	if h.Diagnostics.File == "" {
+		return
+	}
+	err = ioutil.WriteFile(h.Diagnostics.File, bundle.Bytes(), 0644)
+	if err != nil {
+		log.Printf("unable to write diagnostics: %s", err)
+		return
+	}
+	log.Printf("wrote diagnostics to %s", h.Diagnostics.File)
+}
+
+// podSelectors returns the label selectors of the pods of the workloads in
+// the manifest, the instance label of the release if there are none
+func (h *HelmCmd) podSelectors(resources []manifestResource) []podSelector {
+	selectors := []podSelector{}
+	seen := map[podSelector]bool{}
+	for _, resource := range resources {
+		labels := workloadLabels(resource)
+		if len(labels) == 0 {
+			continue
+		}
+		pairs := make([]string, 0, len(labels))
+		for key, value := range labels {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", key, value))
+		}
+		sort.Strings(pairs)
+		selector := podSelector{Namespace: resource.Namespace, Selector: strings.Join(pairs, ",")}
+		if selector.Namespace == "" {
+			selector.Namespace = h.Namespace
+		}
+		if !seen[selector] {
+			seen[selector] = true
+			selectors = append(selectors, selector)
+		}
+	}
+	if len(selectors) == 0 {
+		selectors = append(selectors, podSelector{
+			Namespace: h.Namespace,
+			Selector:  fmt.Sprintf("app.kubernetes.io/instance=%s", h.Release),
+		})
+	}
+	return selectors
+}
+
+// workloadLabels returns the pod selector labels of a workload, the labels
+// of the pod template if the selector is generated
+func workloadLabels(resource manifestResource) map[string]interface{} {
+	var spec interface{} = resource.Object["spec"]
+	switch resource.Kind {
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+	case "CronJob":
+		spec = nested(spec, "jobTemplate", "spec")
+	default:
+		return nil
+	}
+	if labels, ok := nested(spec, "selector", "matchLabels").(map[string]interface{}); ok && len(labels) > 0 {
+		return labels
+	}
+	labels, _ := nested(spec, "template", "metadata", "labels").(map[string]interface{})
+	return labels
+}
+
+// releasePods returns the pods of the workloads of the release
+func (h *HelmCmd) releasePods(ctx context.Context, resources []manifestResource) ([]pod, error) {
+	pods := []pod{}
+	seen := map[string]bool{}
+	for _, selector := range h.podSelectors(resources) {
+		args := append([]string{"get", "pods", "-l", selector.Selector, "-o", "json"}, h.kubeArgs(selector.Namespace)...)
+		out, err := h.Runner.Output(ctx, "kubectl", args...)
+		if err != nil {
+			return pods, err
+		}
+		list := podList{}
+		err = json.Unmarshal(out, &list)
+		if err != nil {
+			return pods, fmt.Errorf("unable to parse pods: %s", err)
+		}
+		for _, pod := range list.Items {
+			if pod.Metadata.Namespace == "" {
+				pod.Metadata.Namespace = selector.Namespace
+			}
+			key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+			if !seen[key] {
+				seen[key] = true
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods, nil
+}
+
+// releaseObject reports if the object belongs to the release: it is part of
+// the manifest, a pod of the release or created by a workload of the release
+// like the ReplicaSets of a Deployment
+func releaseObject(kind, name string, resources []manifestResource, pods []pod) bool {
+	for _, resource := range resources {
+		if resource.Kind == kind && resource.Name == name {
+			return true
+		}
+		if workloadLabels(resource) != nil && strings.HasPrefix(name, resource.Name+"-") {
+			return true
+		}
+	}
+	if kind == "Pod" {
+		for _, pod := range pods {
+			if pod.Metadata.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// diagnoseEvents adds the warning events of the release objects to the
+// summary and all their events to the bundle
+func (h *HelmCmd) diagnoseEvents(ctx context.Context, summary, bundle *bytes.Buffer, resources []manifestResource, pods []pod) error {
+	args := append([]string{"get", "events", "--sort-by=.lastTimestamp", "-o", "json"}, h.connArgs()...)
+	out, err := h.Runner.Output(ctx, "kubectl", args...)
+	if err != nil {
+		return err
+	}
+	events := eventList{}
+	err = json.Unmarshal(out, &events)
+	if err != nil {
+		return fmt.Errorf("unable to parse events: %s", err)
+	}
+
+	fmt.Fprintf(bundle, "== events of release %s ==\n", h.Release)
+	all := tabwriter.NewWriter(bundle, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(all, "LAST SEEN\tTYPE\tREASON\tOBJECT\tCOUNT\tMESSAGE")
+	warnings := []string{}
+	for _, event := range events.Items {
+		if !releaseObject(event.InvolvedObject.Kind, event.InvolvedObject.Name, resources, pods) {
+			continue
+		}
+		object := fmt.Sprintf("%s/%s", strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name)
+		fmt.Fprintf(all, "%s\t%s\t%s\t%s\t%d\t%s\n", event.LastTimestamp, event.Type, event.Reason, object, event.Count, event.Message)
+		if event.Type == "Warning" {
+			warnings = append(warnings, fmt.Sprintf("%s %s: %s", object, event.Reason, event.Message))
+		}
+	}
+	_ = all.Flush()
+	fmt.Fprintln(bundle)
+
+	if len(warnings) > summaryEvents {
+		warnings = warnings[len(warnings)-summaryEvents:]
+	}
+	fmt.Fprintf(summary, "warning events (last %d):\n", summaryEvents)
+	for _, warning := range warnings {
+		fmt.Fprintf(summary, "  %s\n", warning)
+	}
+	return nil
+}
+
+// diagnosePods adds the states of the non-ready pods of the release and the
+// logs of their crashing containers
+func (h *HelmCmd) diagnosePods(ctx context.Context, summary, bundle *bytes.Buffer, pods []pod) {
+	fmt.Fprintf(summary, "non-ready pods:\n")
+	fmt.Fprintf(bundle, "== non-ready pods of release %s ==\n", h.Release)
+	logs := &bytes.Buffer{}
+	for _, pod := range pods {
+		if pod.ready() {
+			continue
+		}
+		line := fmt.Sprintf("pod/%s %s", pod.Metadata.Name, pod.Status.Phase)
+		if pod.Status.Reason != "" {
+			line += fmt.Sprintf(" (%s)", pod.Status.Reason)
+		}
+		fmt.Fprintf(summary, "  %s\n", line)
+		fmt.Fprintf(bundle, "%s\n", line)
+		statuses := append(append([]containerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if status.Ready {
+				continue
+			}
+			line := fmt.Sprintf("container %s: %s, %d restarts", status.Name, status.State, status.RestartCount)
+			if status.LastState.Terminated != nil {
+				line += fmt.Sprintf(", last %s", status.LastState)
+			}
+			fmt.Fprintf(summary, "    %s\n", line)
+			fmt.Fprintf(bundle, "  %s\n", line)
+			if status.crashing() {
+				h.diagnoseLogs(ctx, logs, pod, status)
+			}
+		}
+	}
+	fmt.Fprintln(bundle)
+	_, _ = logs.WriteTo(bundle)
+}
+
+// diagnoseLogs adds the last log lines of the container, the logs of the
+// previous instance if the container restarted
+func (h *HelmCmd) diagnoseLogs(ctx context.Context, logs *bytes.Buffer, p pod, status containerStatus) {
+	pod := p.Metadata.Name
+	args := []string{"logs", pod, "-c", status.Name}
+	if h.Diagnostics.LogLines > 0 {
+		args = append(args, "--tail", fmt.Sprintf("%d", h.Diagnostics.LogLines))
+	}
+	if status.RestartCount > 0 {
+		args = append(args, "--previous")
+	}
+	args = append(args, h.kubeArgs(p.Metadata.Namespace)...)
+	fmt.Fprintf(logs, "== logs of pod/%s container %s ==\n", pod, status.Name)
+	out, err := h.Runner.Output(ctx, "kubectl", args...)
+	if err != nil {
+		fmt.Fprintf(logs, "unable to get logs: %s\n\n", err)
+		return
+	}
+	logs.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		logs.WriteByte('\n')
+	}
+	logs.WriteByte('\n')
+}
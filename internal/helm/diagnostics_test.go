@@ -0,0 +1,163 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+const diagnosticsManifest = `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  selector:
+    matchLabels:
+      component: web
+      name: app
+`
+
+const diagnosticsEvents = `{"items": [
+	{"type": "Normal", "reason": "ScalingReplicaSet", "message": "scaled up", "count": 1, "lastTimestamp": "2021-01-01T09:59:59Z",
+	 "involvedObject": {"kind": "Deployment", "name": "app"}},
+	{"type": "Warning", "reason": "BackOff", "message": "other release", "count": 1, "lastTimestamp": "2021-01-01T10:00:00Z",
+	 "involvedObject": {"kind": "Pod", "name": "other-0"}},
+	{"type": "Normal", "reason": "Scheduled", "message": "assigned", "count": 1, "lastTimestamp": "2021-01-01T10:00:00Z",
+	 "involvedObject": {"kind": "Pod", "name": "app-1"}},
+	{"type": "Warning", "reason": "BackOff", "message": "back-off restarting", "count": 3, "lastTimestamp": "2021-01-01T10:01:00Z",
+	 "involvedObject": {"kind": "Pod", "name": "app-1"}}
+]}`
+
+const diagnosticsPods = `{"items": [
+	{"metadata": {"name": "app-0"}, "status": {"phase": "Running",
+	 "conditions": [{"type": "Ready", "status": "True"}],
+	 "containerStatuses": [{"name": "app", "ready": true, "state": {"running": {}}}]}},
+	{"metadata": {"name": "app-1"}, "status": {"phase": "Running",
+	 "conditions": [{"type": "Ready", "status": "False"}],
+	 "containerStatuses": [
+		{"name": "app", "ready": false, "restartCount": 3,
+		 "state": {"waiting": {"reason": "CrashLoopBackOff"}},
+		 "lastState": {"terminated": {"reason": "Error", "exitCode": 1}}},
+		{"name": "sidecar", "ready": false, "state": {"waiting": {"reason": "ContainerCreating"}}}
+	 ]}}
+]}`
+
+func TestDiagnostics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	dir, err := ioutil.TempDir("", "drone-helm3-diagnostics-")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "diagnostics.txt")
+
+	cmd, err := NewHelmCmd(
+		WithInstallUpgradeMode(),
+		WithRelease("foo"),
+		WithNamespace("foo"),
+		WithKubeConfig("/root/.kube/config"),
+		WithChart("chart"),
+		WithDiagnostics(Diagnostics{Enabled: true, File: file, LogLines: 20}),
+		WithRunner(mockRunner),
+	)
+	if err != nil {
+		t.Fatalf("unable to create helm cmd: %s", err)
+	}
+	gomock.InOrder(
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		).Return(fmt.Errorf("timed out waiting for the condition")),
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "get", "manifest", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config",
+		).Return([]byte(diagnosticsManifest), nil),
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"kubectl", "get", "pods", "-l", "component=web,name=app", "-o", "json", "-n", "foo", "--kubeconfig", "/root/.kube/config",
+		).Return([]byte(diagnosticsPods), nil),
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"kubectl", "get", "events", "--sort-by=.lastTimestamp", "-o", "json", "-n", "foo", "--kubeconfig", "/root/.kube/config",
+		).Return([]byte(diagnosticsEvents), nil),
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"kubectl", "logs", "app-1", "-c", "app", "--tail", "20", "--previous", "-n", "foo", "--kubeconfig", "/root/.kube/config",
+		).Return([]byte("panic: boom"), nil),
+	)
+
+	err = cmd.Run(context.Background())
+	if !errEq(err, fmt.Errorf("helm failed: timed out waiting for the condition")) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unable to read diagnostics: %s", err)
+	}
+	want := `== events of release foo ==
+LAST SEEN             TYPE     REASON             OBJECT          COUNT  MESSAGE
+2021-01-01T09:59:59Z  Normal   ScalingReplicaSet  deployment/app  1      scaled up
+2021-01-01T10:00:00Z  Normal   Scheduled          pod/app-1       1      assigned
+2021-01-01T10:01:00Z  Warning  BackOff            pod/app-1       3      back-off restarting
+
+== non-ready pods of release foo ==
+pod/app-1 Running
+  container app: waiting: CrashLoopBackOff, 3 restarts, last terminated: Error (exit code 1)
+  container sidecar: waiting: ContainerCreating, 0 restarts
+
+== logs of pod/app-1 container app ==
+panic: boom
+
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf(diff)
+	}
+}
+
+func TestPodSelectors(t *testing.T) {
+	cmd := &HelmCmd{Release: "foo", Namespace: "foo"}
+	tests := []struct {
+		name     string
+		manifest string
+		want     []podSelector
+	}{
+		{
+			name:     "no workloads",
+			manifest: "kind: ConfigMap\nmetadata:\n  name: foo\n",
+			want:     []podSelector{{Namespace: "foo", Selector: "app.kubernetes.io/instance=foo"}},
+		},
+		{
+			name: "generated selectors",
+			manifest: "kind: Job\nmetadata:\n  name: migrate\n  namespace: other\nspec:\n  template:\n    metadata:\n      labels:\n        job: migrate\n" +
+				"---\nkind: CronJob\nmetadata:\n  name: cleanup\nspec:\n  jobTemplate:\n    spec:\n      template:\n        metadata:\n          labels:\n            job: cleanup\n",
+			want: []podSelector{{Namespace: "other", Selector: "job=migrate"}, {Namespace: "foo", Selector: "job=cleanup"}},
+		},
+	}
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		resources, err := parseManifest([]byte(test.manifest))
+		if err != nil {
+			t.Fatalf("unable to parse manifest: %s", err)
+		}
+		if diff := cmp.Diff(test.want, cmd.podSelectors(resources)); diff != "" {
+			t.Fatalf(diff)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package helm
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -15,39 +16,127 @@ type (
 	HelmCmd struct {
 		Mode HelmMode
 
-		Release string
-		Chart   string
-		Args    []string
-
-		PreCmds  [][]string
-		PostCmds [][]string
+		Release      string
+		Namespace    string
+		KubeConfig   string
+		Chart        string
+		ChartVersion string
+		ChartDevel   bool
+		Args         []string
+		Stdin        string
+
+		Package       PackageOptions
+		RegistryLogin RegistryLogin
+		Repos         []HelmRepo
+		Cache         *Cache
+
+		PreCmds  []Command
+		PostCmds []Command
 		Runner   Runner
 
+		Timeout      time.Duration
 		Test         bool
 		TestRollback bool
-
-		OnSuccess                   []func()
-		OnTestSuccess               []func()
-		OnTestFailed                []func()
-		OnTestFailedRollbackSuccess []func()
-		OnTestFailedRollbackFailed  []func()
+		TestTimeout  time.Duration
+		TestFilter   []string
+		TestReport   string
+		RollbackWait bool
+
+		Atomic            bool
+		RollbackOnFailure bool
+		RecoverPending    bool
+		CancelCleanup     string
+		CancelTimeout     time.Duration
+		PhaseTimeouts     map[Phase]time.Duration
+		Retry             Retry
+		Lock              Lock
+		ManifestChecks    ManifestChecks
+
+		// Recovered is the action taken to recover a pending release,
+		// rollback or uninstall, empty if none was necessary
+		Recovered string
+
+		Verify        bool
+		VerifyTimeout time.Duration
+		Diagnostics   Diagnostics
+		SmokeChecks   []SmokeCheck
+		SmokeRollback bool
+
+		OnSuccess         []Hook
+		OnFailure         []Hook
+		OnTestSuccess     []Hook
+		OnTestFailed      []Hook
+		OnRollbackSuccess []Hook
+		OnRollbackFailed  []Hook
 	}
 
 	HelmMode = string
 
+	// Phase identifies the step of a HelmCmd a Command belongs to
+	Phase = string
+
+	// Command is an external command, the first argument is the executable
+	Command struct {
+		Phase Phase
+		Args  []string
+		Stdin string
+
+		// Func is run instead of the external command if set, Args are
+		// only informational
+		Func func(ctx context.Context) error
+	}
+
+	// RegistryLogin holds the credentials for a `helm registry login`
+	RegistryLogin struct {
+		Host     string
+		Username string
+		Password string
+		Insecure bool
+		CAFile   string
+	}
+
 	// Build pattern options
 	HelmModeOption func(*HelmCmd)
 	HelmOption     func(*HelmCmd) error
 	Runner         interface {
 		Run(ctx context.Context, command string, args ...string) error
+		RunWithStdin(ctx context.Context, stdin io.Reader, command string, args ...string) error
+		Output(ctx context.Context, command string, args ...string) ([]byte, error)
 	}
 )
 
 const (
 	InstallUpgradeMode HelmMode = "install-upgrade"
 	UninstallMode      HelmMode = "uninstall"
+
+	ociPrefix = "oci://"
 )
 
+const (
+	PhaseRegistryLogin    Phase = "registry-login"
+	PhaseRepoAdd          Phase = "repo-add"
+	PhaseRepoUpdate       Phase = "repo-update"
+	PhaseDependencyBuild  Phase = "dependency-build"
+	PhaseDependencyUpdate Phase = "dependency-update"
+	PhaseLint             Phase = "lint"
+	PhasePreCommand       Phase = "pre-command"
+	PhasePostCommand      Phase = "post-command"
+	PhasePush             Phase = "push"
+	PhaseUpgrade          Phase = "upgrade"
+	PhaseTest             Phase = "test"
+	PhaseRollback         Phase = "rollback"
+)
+
+// IsOCI reports if the chart is a reference to an OCI registry
+func IsOCI(chart string) bool {
+	return strings.HasPrefix(chart, ociPrefix)
+}
+
+// OCIHost returns the registry host of an OCI chart reference
+func OCIHost(chart string) string {
+	return strings.SplitN(strings.TrimPrefix(chart, ociPrefix), "/", 2)[0]
+}
+
 func WithInstallUpgradeMode() HelmModeOption {
 	return func(c *HelmCmd) {
 		c.Mode = InstallUpgradeMode
@@ -76,8 +165,22 @@ func WithChart(chart string) HelmOption {
 	}
 }
 
+// WithChartVersion pins the chart version, for repository charts semver
+// constraints are resolved against the repository index before deploying
+func WithChartVersion(version string, devel bool) HelmOption {
+	return func(c *HelmCmd) error {
+		c.ChartVersion = version
+		c.ChartDevel = devel
+		if version == "" && devel {
+			c.Args = append(c.Args, "--devel")
+		}
+		return nil
+	}
+}
+
 func WithNamespace(namespace string) HelmOption {
 	return func(c *HelmCmd) error {
+		c.Namespace = namespace
 		c.Args = append(c.Args, "-n", namespace)
 		return nil
 	}
@@ -85,10 +188,12 @@ func WithNamespace(namespace string) HelmOption {
 
 func WithLint(lint bool) HelmOption {
 	return func(c *HelmCmd) error {
-		if lint {
-			c.PreCmds = append(c.PreCmds, []string{
+		if lint && IsOCI(c.Chart) {
+			log.Printf("skipping lint for remote chart %q", c.Chart)
+		} else if lint {
+			c.PreCmds = append(c.PreCmds, Command{Phase: PhaseLint, Args: []string{
 				"helm", "lint", c.Chart,
-			})
+			}})
 		}
 		return nil
 	}
@@ -96,6 +201,7 @@ func WithLint(lint bool) HelmOption {
 
 func WithAtomic(atomic bool) HelmOption {
 	return func(c *HelmCmd) error {
+		c.Atomic = atomic
 		if atomic {
 			c.Args = append(c.Args, "--atomic")
 		}
@@ -157,6 +263,15 @@ func WithDisableOpenAPIValidation(disable bool) HelmOption {
 	}
 }
 
+func WithDescription(description string) HelmOption {
+	return func(c *HelmCmd) error {
+		if description != "" {
+			c.Args = append(c.Args, "--description", description)
+		}
+		return nil
+	}
+}
+
 func WithPostKustomization(kustomization string) HelmOption {
 	return func(c *HelmCmd) error {
 		if kustomization != "" {
@@ -176,41 +291,37 @@ func WithPostKustomization(kustomization string) HelmOption {
 
 func WithTimeout(timeout time.Duration) HelmOption {
 	return func(c *HelmCmd) error {
+		c.Timeout = timeout
 		c.Args = append(c.Args, "--timeout", timeout.String())
 		return nil
 	}
 }
 
-func WithHelmRepos(repos []string) HelmOption {
+func WithHelmRepos(repos []HelmRepo) HelmOption {
 	return func(c *HelmCmd) error {
 		if len(repos) == 0 {
 			return nil
 		}
+		c.Repos = append(c.Repos, repos...)
 		for _, repo := range repos {
-			split := strings.SplitN(repo, "=", 2)
-			if len(split) != 2 {
-				return fmt.Errorf("not in key=value format: %s", repo)
-			}
-			name := split[0]
-			url := split[1]
-			log.Printf("added repo: name:%q url:%q", name, url)
-			c.PreCmds = append(c.PreCmds, []string{
-				"helm", "repo", "add", name, url,
-			})
-		}
-		c.PreCmds = append(c.PreCmds, []string{
+			log.Printf("added repo: name:%q url:%q", repo.Name, repo.Masked().URL)
+			c.PreCmds = append(c.PreCmds, repo.command())
+		}
+		c.PreCmds = append(c.PreCmds, Command{Phase: PhaseRepoUpdate, Args: []string{
 			"helm", "repo", "update",
-		})
+		}})
 		return nil
 	}
 }
 
 func WithBuildDependencies(build bool, chart string) HelmOption {
 	return func(c *HelmCmd) error {
-		if build {
-			c.PreCmds = append(c.PreCmds, []string{
+		if build && IsOCI(chart) {
+			log.Printf("skipping dependency build for remote chart %q", chart)
+		} else if build {
+			c.PreCmds = append(c.PreCmds, Command{Phase: PhaseDependencyBuild, Args: []string{
 				"helm", "dependency", "build", chart,
-			})
+			}})
 		}
 		return nil
 	}
@@ -218,10 +329,12 @@ func WithBuildDependencies(build bool, chart string) HelmOption {
 
 func WithUpdateDependencies(update bool, chart string) HelmOption {
 	return func(c *HelmCmd) error {
-		if update {
-			c.PreCmds = append(c.PreCmds, []string{
+		if update && IsOCI(chart) {
+			log.Printf("skipping dependency update for remote chart %q", chart)
+		} else if update {
+			c.PreCmds = append(c.PreCmds, Command{Phase: PhaseDependencyUpdate, Args: []string{
 				"helm", "dependency", "update", chart,
-			})
+			}})
 		}
 		return nil
 	}
@@ -241,6 +354,34 @@ func WithTestRollback(test bool, release string) HelmOption {
 	}
 }
 
+func WithTestTimeout(timeout time.Duration) HelmOption {
+	return func(c *HelmCmd) error {
+		c.TestTimeout = timeout
+		return nil
+	}
+}
+
+// WithTestFilter limits the tests to run, plain names are converted to
+// name=<name> filters
+func WithTestFilter(filters []string) HelmOption {
+	return func(c *HelmCmd) error {
+		for _, filter := range filters {
+			if !strings.Contains(filter, "=") {
+				filter = fmt.Sprintf("name=%s", filter)
+			}
+			c.TestFilter = append(c.TestFilter, filter)
+		}
+		return nil
+	}
+}
+
+func WithRollbackWait(wait bool) HelmOption {
+	return func(c *HelmCmd) error {
+		c.RollbackWait = wait
+		return nil
+	}
+}
+
 func WithValues(values []string) HelmOption {
 	return func(c *HelmCmd) error {
 		for _, v := range values {
@@ -282,7 +423,9 @@ func WithValuesYaml(file string) HelmOption {
 
 func WithValuesYamlAddDefault(add bool, chartpath string) HelmOption {
 	return func(c *HelmCmd) error {
-		if add {
+		if add && IsOCI(chartpath) {
+			return fmt.Errorf("unable to add default values file for remote chart %q", chartpath)
+		} else if add {
 			file := fmt.Sprintf("%s/values.yaml", chartpath)
 			_, err := os.Stat(file)
 			if os.IsNotExist(err) {
@@ -296,14 +439,62 @@ func WithValuesYamlAddDefault(add bool, chartpath string) HelmOption {
 
 func WithPreCommand(command ...string) HelmOption {
 	return func(c *HelmCmd) error {
-		c.PreCmds = append(c.PreCmds, command)
+		c.PreCmds = append(c.PreCmds, Command{Phase: PhasePreCommand, Args: command})
 		return nil
 	}
 }
 
 func WithPostCommand(command ...string) HelmOption {
 	return func(c *HelmCmd) error {
-		c.PostCmds = append(c.PostCmds, command)
+		c.PostCmds = append(c.PostCmds, Command{Phase: PhasePostCommand, Args: command})
+		return nil
+	}
+}
+
+// WithRegistryLogin runs `helm registry login` before all other commands, the
+// password is passed via stdin to keep it out of the process list and logs
+func WithRegistryLogin(login RegistryLogin) HelmOption {
+	return func(c *HelmCmd) error {
+		if login.Host == "" && IsOCI(c.Chart) {
+			login.Host = OCIHost(c.Chart)
+		}
+		if login.Host == "" && IsOCI(c.Package.Push) {
+			login.Host = OCIHost(c.Package.Push)
+		}
+		c.RegistryLogin = login
+		if login.Username == "" {
+			return nil
+		}
+		if login.Host == "" && c.Mode == PackageMode {
+			// credentials are only used for the http upload
+			return nil
+		}
+		if login.Host == "" {
+			return fmt.Errorf("registry login requires a host")
+		}
+		if login.Password == "" {
+			return fmt.Errorf("registry login of %q requires a password", login.Username)
+		}
+		args := []string{
+			"helm", "registry", "login", login.Host,
+			"--username", login.Username, "--password-stdin",
+		}
+		if login.Insecure {
+			args = append(args, "--insecure")
+		}
+		if login.CAFile != "" {
+			args = append(args, "--ca-file", login.CAFile)
+		}
+		log.Printf("added registry login: host:%q username:%q", login.Host, login.Username)
+		c.PreCmds = append([]Command{{Phase: PhaseRegistryLogin, Args: args, Stdin: login.Password}}, c.PreCmds...)
+		if IsOCI(c.Chart) {
+			if login.Insecure {
+				c.Args = append(c.Args, "--insecure-skip-tls-verify")
+			}
+			if login.CAFile != "" {
+				c.Args = append(c.Args, "--ca-file", login.CAFile)
+			}
+		}
 		return nil
 	}
 }
@@ -311,6 +502,7 @@ func WithPostCommand(command ...string) HelmOption {
 func WithKubeConfig(config string) HelmOption {
 	return func(c *HelmCmd) error {
 		if config != "" {
+			c.KubeConfig = config
 			c.Args = append(c.Args, "--kubeconfig", config)
 		}
 		return nil
@@ -327,8 +519,8 @@ func WithRunner(runner Runner) HelmOption {
 func NewHelmCmd(mode HelmModeOption, options ...HelmOption) (*HelmCmd, error) {
 	h := &HelmCmd{
 		Args:     []string{},
-		PreCmds:  [][]string{},
-		PostCmds: [][]string{},
+		PreCmds:  []Command{},
+		PostCmds: []Command{},
 		Runner:   nil,
 	}
 	mode(h)
@@ -338,7 +530,7 @@ func NewHelmCmd(mode HelmModeOption, options ...HelmOption) (*HelmCmd, error) {
 			return nil, fmt.Errorf("unable to parse option: %s", err)
 		}
 	}
-	if h.Release == "" {
+	if h.Release == "" && h.Mode != PackageMode {
 		return nil, fmt.Errorf("release name is required")
 	}
 	if h.Chart == "" && h.Mode != UninstallMode {
@@ -347,47 +539,201 @@ func NewHelmCmd(mode HelmModeOption, options ...HelmOption) (*HelmCmd, error) {
 	if h.Runner == nil {
 		return nil, fmt.Errorf("runner is required")
 	}
+	h.upgradeTimeout()
 
 	switch h.Mode {
 	case InstallUpgradeMode:
 		h.Args = append(h.Args, h.Release, h.Chart)
 	case UninstallMode:
 		h.Args = append(h.Args, h.Release)
+	case PackageMode:
+		h.Args = append(h.Args, h.Chart)
+		if h.Package.Push != "" {
+			push, err := h.pushCommand()
+			if err != nil {
+				return nil, err
+			}
+			h.PostCmds = append([]Command{push}, h.PostCmds...)
+		}
 	default:
 		return nil, fmt.Errorf("mode %q is not known", h.Mode)
 	}
+	if h.Cache != nil {
+		h.PreCmds = h.Cache.wrap(h, h.PreCmds)
+	}
 	return h, nil
 }
 
 func (h *HelmCmd) Run(ctx context.Context) error {
-	for _, preCmd := range h.PreCmds {
-		err := h.Runner.Run(ctx, preCmd[0], preCmd[1:]...)
+	var err error
+	if h.Lock.Enabled && h.Mode != PackageMode {
+		var lockCtx context.Context
+		var unlock func()
+		lockCtx, unlock, err = h.lock(ctx)
 		if err != nil {
+			err = h.prefail(ctx, err, "unable to acquire lock")
+		} else {
+			defer unlock()
+			ctx = lockCtx
+		}
+	}
+	if err == nil {
+		err = h.execute(ctx)
+		if lostErr := h.lockLost(); lostErr != nil {
+			err = Wrap(lostErr, "lock lost", core.CancelledErrorKind)
+		}
+	}
+	if ctx.Err() == context.Canceled {
+		// the hooks still need to reach the cluster
+		var cancel context.CancelFunc
+		ctx, cancel = h.cleanupContext()
+		defer cancel()
+	}
+	if err != nil {
+		h.fire(ctx, h.OnFailure, err)
+	} else {
+		h.fire(ctx, h.OnSuccess, nil)
+	}
+	return err
+}
+
+func (h *HelmCmd) execute(ctx context.Context) error {
+	for _, preCmd := range h.PreCmds {
+		err := h.run(ctx, preCmd)
+		if err != nil && ctx.Err() != nil {
+			return Wrap(err, "cancelled", core.CancelledErrorKind)
+		} else if err != nil {
 			return Wrap(err, "precmd failed", core.PreFailErrorKind)
 		}
 	}
-	err := h.Runner.Run(ctx, "helm", h.Args...)
+	args := h.Args
+	if h.ChartVersion != "" {
+		version := h.ChartVersion
+		// the chart is classified after the pre commands, they may add the
+		// repository or create the local chart
+		repoChart, err := h.repoChart(ctx)
+		if err != nil {
+			return h.prefail(ctx, err, "unable to resolve chart version")
+		}
+		if !repoChart && !IsOCI(h.Chart) {
+			return Wrap(fmt.Errorf("chart version requires a repository or oci chart"), "unable to resolve chart version", core.PreFailErrorKind)
+		}
+		if repoChart {
+			version, err = ResolveChartVersion(h.Chart, h.ChartVersion, h.ChartDevel)
+			if err != nil {
+				return h.prefail(ctx, err, "unable to resolve chart version")
+			}
+			log.Printf("resolved chart version %q to %s", h.ChartVersion, version)
+		}
+		h.ChartVersion = version
+
+		// release and chart are always the last arguments
+		n := len(h.Args) - 2
+		args = append(append(append([]string{}, h.Args[:n]...), "--version", version), h.Args[n:]...)
+	}
+
+	// helm refuses the dry run of the manifest checks on a pending release
+	if h.RecoverPending && h.Mode == InstallUpgradeMode {
+		err := h.recoverPending(ctx)
+		if err != nil {
+			return h.prefail(ctx, err, "unable to recover pending release")
+		}
+	}
+
+	if len(h.ManifestChecks.Rules) > 0 && h.Mode == InstallUpgradeMode {
+		resources, err := h.renderManifest(ctx, args)
+		if err != nil {
+			return h.prefail(ctx, err, "unable to check manifest")
+		}
+		err = h.ManifestChecks.enforce(resources)
+		if err != nil {
+			return Wrap(err, "manifest checks failed", core.ManifestDeniedErrorKind)
+		}
+	}
+
+	var target *rollbackTarget
+	if (h.RollbackOnFailure || h.CancelCleanup == CancelCleanupRollback) && h.Mode == InstallUpgradeMode {
+		var err error
+		target, err = h.rollbackTarget(ctx)
+		if err != nil {
+			return h.prefail(ctx, err, "unable to determine rollback revision")
+		}
+	}
+	err := h.deploy(ctx, args)
+	if err != nil && ctx.Err() == context.Canceled {
+		return h.cancelled(target, err)
+	}
+	if err != nil && h.recovers() {
+		helmErr, ok := err.(*HelmError)
+		if ok && helmErr.Kind == core.FailedErrorKind && h.Atomic {
+			// helm already rolled back the atomic upgrade
+			return err
+		}
+		return h.recover(ctx, target, err)
+	}
+	return err
+}
+
+// prefail wraps an error before the upgrade, errors of a cancelled run are
+// reported as cancelled like during the upgrade
+func (h *HelmCmd) prefail(ctx context.Context, err error, info string) *HelmError {
+	if ctx.Err() == context.Canceled {
+		return Wrap(err, "cancelled", core.CancelledErrorKind)
+	}
+	return Wrap(err, info, core.PreFailErrorKind)
+}
+
+// deploy runs the helm command, the verification, the tests, the smoke
+// checks and the post commands, with rollback on failure failures are left
+// to the recovery
+func (h *HelmCmd) deploy(ctx context.Context, args []string) error {
+	err := h.run(ctx, Command{Phase: h.mainPhase(), Args: append([]string{"helm"}, args...), Stdin: h.Stdin})
 	if err != nil {
+		if h.Diagnostics.Enabled && h.Mode == InstallUpgradeMode {
+			h.diagnose(ctx)
+		}
 		return Wrap(err, "helm failed", core.FailedErrorKind)
 	}
+	if h.Verify {
+		err := h.verify(ctx)
+		if err != nil {
+			return Wrap(err, "rollout verification failed", core.VerifyFailedErrorKind)
+		}
+	}
 	if h.Test {
-		err := h.Runner.Run(ctx, "helm", "test", "--logs", h.Release)
+		var previous map[string]time.Time
+		if h.TestReport != "" {
+			previous = h.testRuns(ctx)
+		}
+		err := h.run(ctx, Command{Phase: PhaseTest, Args: append([]string{"helm"}, h.testArgs()...)})
+		if h.TestReport != "" {
+			reportErr := h.writeTestReport(ctx, previous)
+			if reportErr != nil {
+				log.Printf("unable to create test report: %s", reportErr)
+			}
+		}
 		if err != nil {
 			log.Printf("TEST FAILED: %s", err)
-			if h.TestRollback {
-				rollbackErr := h.Runner.Run(ctx, "helm", "rollback", h.Release)
-				if rollbackErr != nil {
-					log.Printf("ROLLBACK FAILED: %s", rollbackErr)
-					return Wrap(rollbackErr, "release and rollback failed", core.RollbackFailedErrorKind)
-				} else {
-					log.Printf("TEST FAILED: %s", err)
-				}
+			if h.TestRollback && !h.recovers() {
+				return h.rollbackPrevious(ctx, err)
 			}
-			return Wrap(err, "release failed and rollback successful", core.RollbackSuccessErrorKind)
+			wrapped := Wrap(err, "release tests failed", core.TestFailedErrorKind)
+			h.fire(ctx, h.OnTestFailed, wrapped)
+			return wrapped
+		}
+		h.fire(ctx, h.OnTestSuccess, nil)
+	}
+	if len(h.SmokeChecks) > 0 {
+		err := h.smoke(ctx)
+		if err != nil {
+			if h.SmokeRollback && !h.recovers() {
+				return h.rollbackPrevious(ctx, err)
+			}
+			return Wrap(err, "smoke checks failed", core.SmokeFailedErrorKind)
 		}
 	}
 	for _, postCmd := range h.PostCmds {
-		err := h.Runner.Run(ctx, postCmd[0], postCmd[1:]...)
+		err := h.run(ctx, postCmd)
 		if err != nil {
 			return Wrap(err, "postcmd failed", core.PostFailErrorKind)
 		}
@@ -395,11 +741,84 @@ func (h *HelmCmd) Run(ctx context.Context) error {
 	return nil
 }
 
+// rollbackPrevious rolls back to the previous revision after err
+func (h *HelmCmd) rollbackPrevious(ctx context.Context, err error) error {
+	rollbackErr := h.run(ctx, Command{Phase: PhaseRollback, Args: append([]string{"helm"}, h.rollbackArgs(0)...)})
+	if rollbackErr != nil {
+		log.Printf("ROLLBACK FAILED: %s", rollbackErr)
+		wrapped := Wrap(rollbackErr, "release and rollback failed", core.RollbackFailedErrorKind)
+		h.fireRollback(ctx, rollbackErr, wrapped)
+		return wrapped
+	}
+	log.Printf("ROLLBACK SUCCESSFUL")
+	wrapped := Wrap(err, "release failed and rollback successful", core.RollbackSuccessErrorKind)
+	h.fireRollback(ctx, nil, wrapped)
+	return wrapped
+}
+
+// mainPhase returns the phase of the helm command of the mode
+func (h *HelmCmd) mainPhase() Phase {
+	if h.Mode == InstallUpgradeMode {
+		return PhaseUpgrade
+	}
+	return h.Mode
+}
+
+// connArgs returns the arguments to connect to the namespace of the release
+func (h *HelmCmd) connArgs() []string {
+	return h.kubeArgs(h.Namespace)
+}
+
+// kubeArgs returns the arguments to connect to namespace
+func (h *HelmCmd) kubeArgs(namespace string) []string {
+	args := []string{}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	if h.KubeConfig != "" {
+		args = append(args, "--kubeconfig", h.KubeConfig)
+	}
+	return args
+}
+
+// testArgs returns the arguments for `helm test`
+func (h *HelmCmd) testArgs() []string {
+	args := append([]string{"test", "--logs"}, h.connArgs()...)
+	if h.TestTimeout > 0 {
+		args = append(args, "--timeout", h.TestTimeout.String())
+	}
+	for _, filter := range h.TestFilter {
+		args = append(args, "--filter", filter)
+	}
+	return append(args, h.Release)
+}
+
+func (h *HelmCmd) run(parent context.Context, cmd Command) error {
+	ctx, cancel := h.phaseContext(parent, cmd.Phase)
+	defer cancel()
+	var err error
+	if cmd.Func != nil {
+		// functions retry the commands they run themselves
+		err = cmd.Func(ctx)
+	} else {
+		err = h.retry(ctx, cmd.Phase, func() error {
+			if cmd.Stdin != "" {
+				return h.Runner.RunWithStdin(ctx, strings.NewReader(cmd.Stdin), cmd.Args[0], cmd.Args[1:]...)
+			}
+			return h.Runner.Run(ctx, cmd.Args[0], cmd.Args[1:]...)
+		})
+	}
+	return h.phaseError(parent, ctx, cmd.Phase, err)
+}
+
 type (
 	HelmError struct {
 		Context string
 		Kind    core.ErrorKind
 		Err     error
+
+		// Phase is the phase that timed out, empty for other errors
+		Phase Phase
 	}
 )
 
@@ -408,9 +827,16 @@ func (e *HelmError) Error() string {
 }
 
 func Wrap(err error, info string, kind core.ErrorKind) *HelmError {
-	return &HelmError{
+	helmErr := &HelmError{
 		Context: info,
 		Kind:    kind,
 		Err:     err,
 	}
+	switch typed := err.(type) {
+	case *PhaseTimeoutError:
+		helmErr.Phase = typed.Phase
+	case *HelmError:
+		helmErr.Phase = typed.Phase
+	}
+	return helmErr
 }
@@ -3,7 +3,10 @@ package helm
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/bitsbeats/drone-helm3/mock"
 	"github.com/golang/mock/gomock"
@@ -74,6 +77,22 @@ func TestHelmCmd(t *testing.T) {
 				)
 			},
 		},
+		{
+			name: "helm upgrade with description",
+			mode: WithInstallUpgradeMode(),
+			options: []HelmOption{
+				WithRelease("foo"),
+				WithChart("chart"),
+				WithDescription("bitsbeats/myapp commit=21ffea3"),
+				WithRunner(mockRunner),
+			},
+			setup: func() {
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "upgrade", "--install", "--description", "bitsbeats/myapp commit=21ffea3", "foo", "chart",
+				)
+			},
+		},
 		{
 			name: "helm upgrade with dependency build",
 			mode: WithInstallUpgradeMode(),
@@ -120,8 +139,8 @@ func TestHelmCmd(t *testing.T) {
 			options: []HelmOption{
 				WithRelease("foo"),
 				WithChart("chart"),
-				WithHelmRepos([]string{
-					"dev=https://example.com/dev-charts",
+				WithHelmRepos([]HelmRepo{
+					{Name: "dev", URL: "https://example.com/dev-charts"},
 				}),
 				WithRunner(mockRunner),
 			},
@@ -140,6 +159,90 @@ func TestHelmCmd(t *testing.T) {
 				)
 			},
 		},
+		{
+			name: "helm upgrade with oci chart and registry login",
+			mode: WithInstallUpgradeMode(),
+			options: []HelmOption{
+				WithRelease("foo"),
+				WithChart("oci://registry.example.com/charts/foo"),
+				WithLint(true),
+				WithBuildDependencies(true, "oci://registry.example.com/charts/foo"),
+				WithRegistryLogin(RegistryLogin{
+					Username: "user",
+					Password: "secret",
+					CAFile:   "/etc/ssl/registry.pem",
+				}),
+				WithRunner(mockRunner),
+			},
+			setup: func() {
+				mockRunner.EXPECT().RunWithStdin(
+					context.Background(), readerEq("secret"),
+					"helm", "registry", "login", "registry.example.com",
+					"--username", "user", "--password-stdin",
+					"--ca-file", "/etc/ssl/registry.pem",
+				)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "upgrade", "--install", "--ca-file", "/etc/ssl/registry.pem",
+					"foo", "oci://registry.example.com/charts/foo",
+				)
+			},
+		},
+		{
+			name: "helm upgrade with registry login without password",
+			mode: WithInstallUpgradeMode(),
+			options: []HelmOption{
+				WithRelease("foo"),
+				WithChart("oci://registry.example.com/charts/foo"),
+				WithRegistryLogin(RegistryLogin{Username: "user"}),
+				WithRunner(mockRunner),
+			},
+			createErr: fmt.Errorf("unable to parse option: registry login of \"user\" requires a password"),
+		},
+		{
+			name: "helm upgrade with oci chart and default values",
+			mode: WithInstallUpgradeMode(),
+			options: []HelmOption{
+				WithRelease("foo"),
+				WithChart("oci://registry.example.com/charts/foo"),
+				WithValuesYamlAddDefault(true, "oci://registry.example.com/charts/foo"),
+				WithRunner(mockRunner),
+			},
+			createErr: fmt.Errorf("unable to parse option: unable to add default values file for remote chart \"oci://registry.example.com/charts/foo\""),
+		},
+		{
+			name: "helm upgrade with authenticated repo",
+			mode: WithInstallUpgradeMode(),
+			options: []HelmOption{
+				WithRelease("foo"),
+				WithChart("chart"),
+				WithHelmRepos([]HelmRepo{
+					{
+						Name:     "private",
+						URL:      "https://charts.example.com",
+						Username: "user",
+						Password: "secret",
+						CAFile:   "/etc/ssl/charts.pem",
+					},
+				}),
+				WithRunner(mockRunner),
+			},
+			setup: func() {
+				mockRunner.EXPECT().RunWithStdin(
+					context.Background(), readerEq("secret"),
+					"helm", "repo", "add", "private", "https://charts.example.com",
+					"--username", "user", "--password-stdin", "--ca-file", "/etc/ssl/charts.pem",
+				)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "repo", "update",
+				)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "upgrade", "--install", "foo", "chart",
+				)
+			},
+		},
 		{
 			name: "helm upgrade with force, wait, disabled default values.yaml, values.yaml and set",
 			mode: WithInstallUpgradeMode(),
@@ -337,7 +440,7 @@ func TestHelmCmd(t *testing.T) {
 				)
 				mockRunner.EXPECT().Run(
 					context.Background(),
-					"helm", "test", "--logs", "myapp-production",
+					"helm", "test", "--logs", "-n", "myapp-production", "myapp-production",
 				)
 			},
 			runErr: nil,
@@ -360,10 +463,10 @@ func TestHelmCmd(t *testing.T) {
 				)
 				mockRunner.EXPECT().Run(
 					context.Background(),
-					"helm", "test", "--logs", "myapp-production",
+					"helm", "test", "--logs", "-n", "myapp-production", "myapp-production",
 				).Return(fmt.Errorf("testfail"))
 			},
-			runErr: fmt.Errorf("release failed and rollback successful: testfail"),
+			runErr: fmt.Errorf("release tests failed: testfail"),
 		},
 		{
 			name: "with failed test and sucessfull rollback",
@@ -384,11 +487,11 @@ func TestHelmCmd(t *testing.T) {
 				)
 				mockRunner.EXPECT().Run(
 					context.Background(),
-					"helm", "test", "--logs", "myapp-production",
+					"helm", "test", "--logs", "-n", "myapp-production", "myapp-production",
 				).Return(fmt.Errorf("testfail"))
 				mockRunner.EXPECT().Run(
 					context.Background(),
-					"helm", "rollback", "myapp-production",
+					"helm", "rollback", "-n", "myapp-production", "myapp-production",
 				)
 			},
 			runErr: fmt.Errorf("release failed and rollback successful: testfail"),
@@ -412,15 +515,50 @@ func TestHelmCmd(t *testing.T) {
 				)
 				mockRunner.EXPECT().Run(
 					context.Background(),
-					"helm", "test", "--logs", "myapp-production",
+					"helm", "test", "--logs", "-n", "myapp-production", "myapp-production",
 				).Return(fmt.Errorf("testfail"))
 				mockRunner.EXPECT().Run(
 					context.Background(),
-					"helm", "rollback", "myapp-production",
+					"helm", "rollback", "-n", "myapp-production", "myapp-production",
 				).Return(fmt.Errorf("rollbackfail"))
 			},
 			runErr: fmt.Errorf("release and rollback failed: rollbackfail"),
 		},
+		{
+			name: "with failed test and rollback using connection options",
+			mode: WithInstallUpgradeMode(),
+			options: []HelmOption{
+				WithNamespace("myapp-production"),
+				WithRelease("myapp-production"),
+				WithChart("./helm/myapp"),
+				WithTimeout(10 * time.Minute),
+				WithTest(true, "myapp-release"),
+				WithTestRollback(true, "myapp-release"),
+				WithTestTimeout(2 * time.Minute),
+				WithTestFilter([]string{"smoke", "!name=slow"}),
+				WithRollbackWait(true),
+				WithKubeConfig("/root/.kube/config"),
+				WithRunner(mockRunner),
+			},
+			setup: func() {
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "upgrade", "--install", "-n", "myapp-production", "--timeout", "10m0s",
+					"--kubeconfig", "/root/.kube/config", "myapp-production", "./helm/myapp",
+				)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "test", "--logs", "-n", "myapp-production", "--kubeconfig", "/root/.kube/config",
+					"--timeout", "2m0s", "--filter", "name=smoke", "--filter", "!name=slow", "myapp-production",
+				).Return(fmt.Errorf("testfail"))
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "rollback", "-n", "myapp-production", "--kubeconfig", "/root/.kube/config",
+					"--timeout", "10m0s", "--wait", "myapp-production",
+				)
+			},
+			runErr: fmt.Errorf("release failed and rollback successful: testfail"),
+		},
 		{
 			name: "with helm uninstall",
 			mode: WithUninstallMode(),
@@ -453,6 +591,22 @@ func TestHelmCmd(t *testing.T) {
 	}
 }
 
+// readerEq matches an io.Reader by its content
+type readerEq string
+
+func (r readerEq) Matches(x interface{}) bool {
+	reader, ok := x.(io.Reader)
+	if !ok {
+		return false
+	}
+	data, err := ioutil.ReadAll(reader)
+	return err == nil && string(data) == string(r)
+}
+
+func (r readerEq) String() string {
+	return fmt.Sprintf("reader with content %q", string(r))
+}
+
 func errEq(a error, b error) bool {
 	return fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b)
 }
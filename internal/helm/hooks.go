@@ -0,0 +1,169 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/bitsbeats/drone-helm3/internal/core"
+)
+
+type (
+	// Outcome describes the state of a HelmCmd run passed to hooks
+	Outcome struct {
+		Release   string
+		Namespace string
+		Revision  int
+		Err       error
+	}
+
+	// Hook is called at the lifecycle points of a HelmCmd run
+	Hook func(ctx context.Context, outcome *Outcome) error
+
+	// releaseStatus is the subset of `helm status -o json`
+	releaseStatus struct {
+		Version int `json:"version"`
+		Info    struct {
+			Status string `json:"status"`
+		} `json:"info"`
+		Hooks []releaseHook `json:"hooks"`
+	}
+)
+
+// Kind returns the error kind of the outcome, empty on success
+func (o *Outcome) Kind() core.ErrorKind {
+	if o.Err == nil {
+		return ""
+	}
+	if helmErr, ok := o.Err.(*HelmError); ok {
+		return helmErr.Kind
+	}
+	return core.FailedErrorKind
+}
+
+// Env returns the outcome as environment variables
+func (o *Outcome) Env() []string {
+	env := []string{
+		fmt.Sprintf("DRONE_HELM3_RELEASE=%s", o.Release),
+		fmt.Sprintf("DRONE_HELM3_NAMESPACE=%s", o.Namespace),
+		fmt.Sprintf("DRONE_HELM3_REVISION=%d", o.Revision),
+		fmt.Sprintf("DRONE_HELM3_ERROR_KIND=%s", o.Kind()),
+	}
+	if o.Err != nil {
+		env = append(env, fmt.Sprintf("DRONE_HELM3_ERROR=%s", o.Err))
+	} else {
+		env = append(env, "DRONE_HELM3_ERROR=")
+	}
+	return env
+}
+
+func WithOnSuccess(hook Hook) HelmOption {
+	return func(c *HelmCmd) error {
+		if hook != nil {
+			c.OnSuccess = append(c.OnSuccess, hook)
+		}
+		return nil
+	}
+}
+
+func WithOnFailure(hook Hook) HelmOption {
+	return func(c *HelmCmd) error {
+		if hook != nil {
+			c.OnFailure = append(c.OnFailure, hook)
+		}
+		return nil
+	}
+}
+
+func WithOnTestSuccess(hook Hook) HelmOption {
+	return func(c *HelmCmd) error {
+		if hook != nil {
+			c.OnTestSuccess = append(c.OnTestSuccess, hook)
+		}
+		return nil
+	}
+}
+
+func WithOnTestFailed(hook Hook) HelmOption {
+	return func(c *HelmCmd) error {
+		if hook != nil {
+			c.OnTestFailed = append(c.OnTestFailed, hook)
+		}
+		return nil
+	}
+}
+
+// WithOnRollback is called after a rollback, successful or not, whatever
+// step failed
+func WithOnRollback(hook Hook) HelmOption {
+	return func(c *HelmCmd) error {
+		if hook == nil {
+			return nil
+		}
+		c.OnRollbackSuccess = append(c.OnRollbackSuccess, hook)
+		c.OnRollbackFailed = append(c.OnRollbackFailed, hook)
+		return nil
+	}
+}
+
+// WithPostHook runs the hook as post command, a failing hook fails the run
+func WithPostHook(hook Hook) HelmOption {
+	return func(c *HelmCmd) error {
+		if hook == nil {
+			return nil
+		}
+		c.PostCmds = append(c.PostCmds, Command{
+			Phase: PhasePostCommand,
+			Args:  []string{"post-hook"},
+			Func: func(ctx context.Context) error {
+				return hook(ctx, c.outcome(ctx, nil))
+			},
+		})
+		return nil
+	}
+}
+
+// fire calls the hooks, failing hooks are only logged
+func (h *HelmCmd) fire(ctx context.Context, hooks []Hook, err error) {
+	if len(hooks) == 0 {
+		return
+	}
+	outcome := h.outcome(ctx, err)
+	for _, hook := range hooks {
+		hookErr := hook(ctx, outcome)
+		if hookErr != nil {
+			log.Printf("hook failed: %s", hookErr)
+		}
+	}
+}
+
+// outcome collects the current state of the release
+func (h *HelmCmd) outcome(ctx context.Context, err error) *Outcome {
+	outcome := &Outcome{
+		Release:   h.Release,
+		Namespace: h.Namespace,
+		Err:       err,
+	}
+	status, statusErr := h.status(ctx)
+	if statusErr == nil {
+		outcome.Revision = status.Version
+	}
+	return outcome
+}
+
+// status returns the `helm status` of the release
+func (h *HelmCmd) status(ctx context.Context) (*releaseStatus, error) {
+	args := append([]string{"status", h.Release}, h.connArgs()...)
+	args = append(args, "-o", "json")
+	out, err := h.query(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	status := &releaseStatus{}
+	err = json.Unmarshal(out, status)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse release status: %s", err)
+	}
+	return status, nil
+}
@@ -0,0 +1,174 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHooks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	fired := []string{}
+	hook := func(name string, err error) Hook {
+		return func(ctx context.Context, outcome *Outcome) error {
+			fired = append(fired, fmt.Sprintf("%s:%d:%s", name, outcome.Revision, outcome.Kind()))
+			return err
+		}
+	}
+	expectStatus := func() {
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "status", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return([]byte(`{"version": 3, "info": {"status": "deployed"}}`), nil)
+	}
+	expectUpgrade := func(err error) {
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		).Return(err)
+	}
+
+	tests := []struct {
+		name   string
+		extra  []HelmOption
+		setup  func()
+		runErr error
+		fired  []string
+	}{
+		{
+			name: "success with post hook",
+			extra: []HelmOption{
+				WithPostHook(hook("post", nil)),
+				WithOnSuccess(hook("success", nil)),
+				WithOnFailure(hook("failure", nil)),
+			},
+			setup: func() {
+				expectUpgrade(nil)
+				expectStatus()
+				expectStatus()
+			},
+			fired: []string{"post:3:", "success:3:"},
+		},
+		{
+			name: "failed post hook",
+			extra: []HelmOption{
+				WithPostHook(hook("post", fmt.Errorf("hookfail"))),
+				WithOnSuccess(hook("success", nil)),
+				WithOnFailure(hook("failure", nil)),
+			},
+			setup: func() {
+				expectUpgrade(nil)
+				expectStatus()
+				expectStatus()
+			},
+			runErr: fmt.Errorf("postcmd failed: hookfail"),
+			fired:  []string{"post:3:", "failure:3:postfail"},
+		},
+		{
+			name: "failed upgrade",
+			extra: []HelmOption{
+				WithOnSuccess(hook("success", nil)),
+				WithOnFailure(hook("failure", fmt.Errorf("ignored"))),
+			},
+			setup: func() {
+				expectUpgrade(fmt.Errorf("runfail"))
+				expectStatus()
+			},
+			runErr: fmt.Errorf("helm failed: runfail"),
+			fired:  []string{"failure:3:failed"},
+		},
+		{
+			name: "failed test without rollback",
+			extra: []HelmOption{
+				WithTest(true, "foo"),
+				WithOnTestFailed(hook("testfailed", nil)),
+				WithOnRollback(hook("rollback", nil)),
+			},
+			setup: func() {
+				expectUpgrade(nil)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "test", "--logs", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo",
+				).Return(fmt.Errorf("testfail"))
+				expectStatus()
+			},
+			runErr: fmt.Errorf("release tests failed: testfail"),
+			fired:  []string{"testfailed:3:test_failed"},
+		},
+		{
+			name: "failed test with rollback",
+			extra: []HelmOption{
+				WithTest(true, "foo"),
+				WithTestRollback(true, "foo"),
+				WithOnTestFailed(hook("testfailed", nil)),
+				WithOnRollback(hook("rollback", nil)),
+				WithOnFailure(hook("failure", nil)),
+			},
+			setup: func() {
+				expectUpgrade(nil)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "test", "--logs", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo",
+				).Return(fmt.Errorf("testfail"))
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "rollback", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo",
+				)
+				expectStatus()
+				expectStatus()
+			},
+			runErr: fmt.Errorf("release failed and rollback successful: testfail"),
+			fired:  []string{"rollback:3:rollback_success", "failure:3:rollback_success"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		fired = []string{}
+		options := append([]HelmOption{
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			WithRunner(mockRunner),
+		}, test.extra...)
+		cmd, err := NewHelmCmd(WithInstallUpgradeMode(), options...)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		test.setup()
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+		if diff := cmp.Diff(test.fired, fired); diff != "" {
+			t.Fatalf(diff)
+		}
+	}
+}
+
+func TestOutcomeEnv(t *testing.T) {
+	outcome := &Outcome{
+		Release:   "foo",
+		Namespace: "bar",
+		Revision:  4,
+		Err:       Wrap(fmt.Errorf("runfail"), "helm failed", "failed"),
+	}
+	want := []string{
+		"DRONE_HELM3_RELEASE=foo",
+		"DRONE_HELM3_NAMESPACE=bar",
+		"DRONE_HELM3_REVISION=4",
+		"DRONE_HELM3_ERROR_KIND=failed",
+		"DRONE_HELM3_ERROR=helm failed: runfail",
+	}
+	if diff := cmp.Diff(want, outcome.Env()); diff != "" {
+		t.Fatalf(diff)
+	}
+}
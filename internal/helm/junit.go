@@ -0,0 +1,190 @@
+package helm
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+type (
+	// releaseHook is a hook of the release from `helm status -o json`
+	releaseHook struct {
+		Name    string   `json:"name"`
+		Kind    string   `json:"kind"`
+		Events  []string `json:"events"`
+		LastRun struct {
+			StartedAt   time.Time `json:"started_at"`
+			CompletedAt time.Time `json:"completed_at"`
+			Phase       string    `json:"phase"`
+		} `json:"last_run"`
+	}
+
+	junitTestSuites struct {
+		XMLName xml.Name         `xml:"testsuites"`
+		Suites  []junitTestSuite `xml:"testsuite"`
+	}
+
+	junitTestSuite struct {
+		Name     string          `xml:"name,attr"`
+		Tests    int             `xml:"tests,attr"`
+		Failures int             `xml:"failures,attr"`
+		Skipped  int             `xml:"skipped,attr"`
+		Time     string          `xml:"time,attr"`
+		Cases    []junitTestCase `xml:"testcase"`
+	}
+
+	junitTestCase struct {
+		Name      string        `xml:"name,attr"`
+		ClassName string        `xml:"classname,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitFailure `xml:"failure,omitempty"`
+		Skipped   *junitSkipped `xml:"skipped,omitempty"`
+		SystemOut string        `xml:"system-out,omitempty"`
+	}
+
+	junitFailure struct {
+		Message string `xml:"message,attr"`
+		Content string `xml:",chardata"`
+	}
+
+	junitSkipped struct {
+		Message string `xml:"message,attr"`
+	}
+)
+
+// WithTestReport writes a JUnit XML report of the helm tests to file
+func WithTestReport(file string) HelmOption {
+	return func(c *HelmCmd) error {
+		c.TestReport = file
+		return nil
+	}
+}
+
+// isTest reports if the hook is a helm test
+func (hook *releaseHook) isTest() bool {
+	for _, event := range hook.Events {
+		if event == "test" || event == "test-success" {
+			return true
+		}
+	}
+	return false
+}
+
+// testSelected reports if the test filters select the test hook
+func (h *HelmCmd) testSelected(name string) bool {
+	included, positive := false, false
+	for _, filter := range h.TestFilter {
+		if strings.HasPrefix(filter, "!name=") {
+			if name == strings.TrimPrefix(filter, "!name=") {
+				return false
+			}
+			continue
+		}
+		positive = true
+		if name == strings.TrimPrefix(filter, "name=") {
+			included = true
+		}
+	}
+	return included || !positive
+}
+
+// testRuns returns the start of the last run of each test hook, the clocks
+// of the plugin and the cluster may differ so runs are only compared with
+// each other
+func (h *HelmCmd) testRuns(ctx context.Context) map[string]time.Time {
+	runs := map[string]time.Time{}
+	status, err := h.status(ctx)
+	if err != nil {
+		log.Printf("unable to get test runs before the tests, all tests with a run are reported: %s", err)
+		return runs
+	}
+	for _, hook := range status.Hooks {
+		if hook.isTest() {
+			runs[hook.Name] = hook.LastRun.StartedAt
+		}
+	}
+	return runs
+}
+
+// writeTestReport collects the results and logs of the test hooks and writes
+// them as JUnit XML, tests whose last run did not change since previous are
+// reported as skipped
+func (h *HelmCmd) writeTestReport(ctx context.Context, previous map[string]time.Time) error {
+	status, err := h.status(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get release status: %s", err)
+	}
+
+	suite := junitTestSuite{Name: h.Release}
+	var total time.Duration
+	for _, hook := range status.Hooks {
+		if !hook.isTest() {
+			continue
+		}
+		ran := !hook.LastRun.StartedAt.IsZero() && !hook.LastRun.StartedAt.Equal(previous[hook.Name])
+		if !h.testSelected(hook.Name) || !ran {
+			suite.Skipped++
+			suite.Cases = append(suite.Cases, junitTestCase{
+				Name:      hook.Name,
+				ClassName: h.Release,
+				Time:      "0.000",
+				Skipped:   &junitSkipped{Message: fmt.Sprintf("test %s did not run", hook.Name)},
+			})
+			continue
+		}
+		duration := hook.LastRun.CompletedAt.Sub(hook.LastRun.StartedAt)
+		if duration < 0 {
+			duration = 0
+		}
+		total += duration
+
+		logs, err := h.hookLogs(ctx, hook)
+		if err != nil {
+			logs = fmt.Sprintf("unable to get logs: %s", err)
+		}
+		testCase := junitTestCase{
+			Name:      hook.Name,
+			ClassName: h.Release,
+			Time:      fmt.Sprintf("%.3f", duration.Seconds()),
+			SystemOut: logs,
+		}
+		if hook.LastRun.Phase != "Succeeded" {
+			suite.Failures++
+			testCase.Failure = &junitFailure{
+				Message: fmt.Sprintf("test %s finished with phase %s", hook.Name, hook.LastRun.Phase),
+				Content: logs,
+			}
+			testCase.SystemOut = ""
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Tests = len(suite.Cases)
+	suite.Time = fmt.Sprintf("%.3f", total.Seconds())
+
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to render test report: %s", err)
+	}
+	data = append([]byte(xml.Header), data...)
+	err = ioutil.WriteFile(h.TestReport, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write test report: %s", err)
+	}
+	log.Printf("wrote test report with %d tests, %d failures and %d skipped to %s", suite.Tests, suite.Failures, suite.Skipped, h.TestReport)
+	return nil
+}
+
+// hookLogs returns the logs of all containers of a test hook
+func (h *HelmCmd) hookLogs(ctx context.Context, hook releaseHook) (string, error) {
+	resource := fmt.Sprintf("%s/%s", strings.ToLower(hook.Kind), hook.Name)
+	args := append([]string{"logs", resource, "--all-containers"}, h.connArgs()...)
+	out, err := h.Runner.Output(ctx, "kubectl", args...)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,131 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTestReport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	dir, err := ioutil.TempDir("", "drone-helm3-junit-")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.xml")
+
+	cmd, err := NewHelmCmd(
+		WithInstallUpgradeMode(),
+		WithRelease("foo"),
+		WithNamespace("bar"),
+		WithKubeConfig("/root/.kube/config"),
+		WithChart("chart"),
+		WithTest(true, "foo"),
+		WithTestFilter([]string{"!name=foo-test-excluded"}),
+		WithTestReport(report),
+		WithRunner(mockRunner),
+	)
+	if err != nil {
+		t.Fatalf("unable to create helm cmd: %s", err)
+	}
+
+	// the clock of the cluster is behind the plugin, only the runs before and
+	// after the tests are compared
+	status := func(hooks string) []byte {
+		return []byte(fmt.Sprintf(`{"version": 2, "hooks": [
+			{"name": "foo-migrate", "kind": "Job", "events": ["pre-upgrade"]},
+			%s,
+			{"name": "foo-test-new", "kind": "Pod", "events": ["test"]}
+		]}`, hooks))
+	}
+	previous := `
+		{"name": "foo-test-ok", "kind": "Pod", "events": ["test"], "last_run": {
+			"started_at": "2021-01-01T09:00:00Z", "completed_at": "2021-01-01T09:00:01Z", "phase": "Succeeded"}},
+		{"name": "foo-test-fail", "kind": "Pod", "events": ["test"]},
+		{"name": "foo-test-stale", "kind": "Pod", "events": ["test"], "last_run": {
+			"started_at": "2021-01-01T09:00:00Z", "completed_at": "2021-01-01T09:00:01Z", "phase": "Succeeded"}},
+		{"name": "foo-test-excluded", "kind": "Pod", "events": ["test"], "last_run": {
+			"started_at": "2021-01-01T09:00:00Z", "completed_at": "2021-01-01T09:00:02Z", "phase": "Failed"}}`
+	current := `
+		{"name": "foo-test-ok", "kind": "Pod", "events": ["test"], "last_run": {
+			"started_at": "2021-01-01T10:00:00Z", "completed_at": "2021-01-01T10:00:01.5Z", "phase": "Succeeded"}},
+		{"name": "foo-test-fail", "kind": "Pod", "events": ["test"], "last_run": {
+			"started_at": "2021-01-01T10:00:00Z", "completed_at": "2021-01-01T10:00:02Z", "phase": "Failed"}},
+		{"name": "foo-test-stale", "kind": "Pod", "events": ["test"], "last_run": {
+			"started_at": "2021-01-01T09:00:00Z", "completed_at": "2021-01-01T09:00:01Z", "phase": "Succeeded"}},
+		{"name": "foo-test-excluded", "kind": "Pod", "events": ["test"], "last_run": {
+			"started_at": "2021-01-01T09:00:00Z", "completed_at": "2021-01-01T09:00:02Z", "phase": "Failed"}}`
+	expectStatus := func(hooks string) *gomock.Call {
+		return mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "status", "foo", "-n", "bar", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return(status(hooks), nil)
+	}
+
+	gomock.InOrder(
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "bar", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		),
+		expectStatus(previous),
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "test", "--logs", "-n", "bar", "--kubeconfig", "/root/.kube/config",
+			"--filter", "!name=foo-test-excluded", "foo",
+		).Return(fmt.Errorf("testfail")),
+		expectStatus(current),
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"kubectl", "logs", "pod/foo-test-ok", "--all-containers", "-n", "bar", "--kubeconfig", "/root/.kube/config",
+		).Return([]byte("ok\n"), nil),
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"kubectl", "logs", "pod/foo-test-fail", "--all-containers", "-n", "bar", "--kubeconfig", "/root/.kube/config",
+		).Return(nil, fmt.Errorf("not found")),
+	)
+
+	err = cmd.Run(context.Background())
+	if !errEq(err, fmt.Errorf("release tests failed: testfail")) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatalf("unable to read report: %s", err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="foo" tests="5" failures="1" skipped="3" time="3.500">
+    <testcase name="foo-test-ok" classname="foo" time="1.500">
+      <system-out>ok&#xA;</system-out>
+    </testcase>
+    <testcase name="foo-test-fail" classname="foo" time="2.000">
+      <failure message="test foo-test-fail finished with phase Failed">unable to get logs: not found</failure>
+    </testcase>
+    <testcase name="foo-test-stale" classname="foo" time="0.000">
+      <skipped message="test foo-test-stale did not run"></skipped>
+    </testcase>
+    <testcase name="foo-test-excluded" classname="foo" time="0.000">
+      <skipped message="test foo-test-excluded did not run"></skipped>
+    </testcase>
+    <testcase name="foo-test-new" classname="foo" time="0.000">
+      <skipped message="test foo-test-new did not run"></skipped>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf(diff)
+	}
+}
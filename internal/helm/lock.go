@@ -0,0 +1,307 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+type (
+	// Lock configures a Lease in the namespace of the release that keeps
+	// concurrent builds from deploying the same release
+	Lock struct {
+		Enabled bool
+
+		// Holder identifies the build, usually the drone build link
+		Holder string
+
+		// Timeout is the maximum wait for a lock held by another build
+		Timeout time.Duration
+
+		// Duration is the lifetime of the lease, it is renewed every third
+		// of it and taken over by other builds if it expired
+		Duration time.Duration
+
+		// now and poll are replaced in tests
+		now  func() time.Time
+		poll time.Duration
+
+		// lost is closed if the lease was lost during the run, lostErr is
+		// the reason
+		lost    chan struct{}
+		lostErr error
+	}
+
+	// lease is the subset of a coordination.k8s.io/v1 Lease
+	lease struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name            string            `json:"name,omitempty"`
+			Namespace       string            `json:"namespace,omitempty"`
+			ResourceVersion string            `json:"resourceVersion,omitempty"`
+			Annotations     map[string]string `json:"annotations,omitempty"`
+		} `json:"metadata"`
+		Spec leaseSpec `json:"spec"`
+	}
+
+	leaseSpec struct {
+		HolderIdentity       *string `json:"holderIdentity"`
+		LeaseDurationSeconds int     `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          *string `json:"acquireTime,omitempty"`
+		RenewTime            *string `json:"renewTime"`
+	}
+)
+
+const (
+	lockPrefix          = "drone-helm3-"
+	lockBuildAnnotation = "drone-helm3/build-link"
+	lockTimeFormat      = "2006-01-02T15:04:05.000000Z07:00"
+	defaultLockDuration = time.Minute
+	defaultLockPoll     = 10 * time.Second
+)
+
+// WithLock acquires a Lease named after the release before the run
+func WithLock(lock Lock) HelmOption {
+	return func(c *HelmCmd) error {
+		if lock.Duration <= 0 {
+			lock.Duration = defaultLockDuration
+		}
+		if lock.now == nil {
+			lock.now = time.Now
+		}
+		if lock.poll <= 0 {
+			lock.poll = defaultLockPoll
+		}
+		c.Lock = lock
+		return nil
+	}
+}
+
+// lock acquires the lease, waiting for other holders up to the lock timeout,
+// and renews it until the returned release func is called. The returned
+// context is cancelled if the lease is lost, so two builds never deploy the
+// release at the same time.
+func (h *HelmCmd) lock(ctx context.Context) (context.Context, func(), error) {
+	deadline := h.Lock.now().Add(h.Lock.Timeout)
+	for {
+		acquired, holder, err := h.tryLock(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if acquired {
+			break
+		}
+		if !h.Lock.now().Before(deadline) {
+			return nil, nil, fmt.Errorf("release %s is locked by %s", h.Release, holder)
+		}
+		log.Printf("release %s is locked by %s, waiting", h.Release, holder)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(h.Lock.poll):
+		}
+	}
+	log.Printf("acquired lock %s%s", lockPrefix, h.Release)
+
+	runCtx, cancelRun := context.WithCancel(ctx)
+	h.Lock.lost = make(chan struct{})
+	lose := func(err error) {
+		log.Printf("LOCK LOST: %s", err)
+		h.Lock.lostErr = err
+		close(h.Lock.lost)
+		cancelRun()
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(h.Lock.Duration / 3)
+		defer ticker.Stop()
+		renewed := h.Lock.now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				acquired, holder, err := h.tryLock(runCtx)
+				switch {
+				case runCtx.Err() != nil:
+					// the run is cancelled, the lease is released by the caller
+				case err == nil && acquired:
+					renewed = h.Lock.now()
+				case err == nil:
+					lose(fmt.Errorf("taken over by %s", holder))
+					return
+				case h.Lock.now().After(renewed.Add(h.Lock.Duration)):
+					lose(fmt.Errorf("not renewed within %s: %s", h.Lock.Duration, err))
+					return
+				default:
+					log.Printf("unable to renew lock, retrying: %s", err)
+				}
+			}
+		}
+	}()
+
+	return runCtx, func() {
+		close(stop)
+		<-stopped
+		cancelRun()
+		// the lock has to be released even if the run was cancelled
+		releaseCtx, cancel := h.cleanupContext()
+		defer cancel()
+		err := h.unlock(releaseCtx)
+		if err != nil {
+			log.Printf("unable to release lock: %s", err)
+			return
+		}
+		log.Printf("released lock %s%s", lockPrefix, h.Release)
+	}, nil
+}
+
+// lockLost returns the reason if the lease was lost during the run
+func (h *HelmCmd) lockLost() error {
+	if h.Lock.lost == nil {
+		return nil
+	}
+	select {
+	case <-h.Lock.lost:
+		return h.Lock.lostErr
+	default:
+		return nil
+	}
+}
+
+// tryLock creates, renews or takes over the lease, it returns the current
+// holder if the lease is held by another build
+func (h *HelmCmd) tryLock(ctx context.Context) (bool, string, error) {
+	current, err := h.getLease(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	now := h.Lock.now().UTC().Format(lockTimeFormat)
+	if current == nil {
+		created := h.newLease(now)
+		manifest, err := json.Marshal(created)
+		if err != nil {
+			return false, "", fmt.Errorf("unable to render lease: %s", err)
+		}
+		args := append([]string{"create", "-f", "-"}, h.connArgs()...)
+		err = h.Runner.RunWithStdin(ctx, strings.NewReader(string(manifest)), "kubectl", args...)
+		if err != nil && strings.Contains(commandOutput(err), "AlreadyExists") {
+			return false, "another build", nil
+		} else if err != nil {
+			return false, "", fmt.Errorf("unable to create lease: %s", err)
+		}
+		return true, "", nil
+	}
+
+	holder := ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	if holder != "" && holder != h.Lock.Holder && !h.expired(current) {
+		return false, holder, nil
+	}
+
+	// the resource version makes the update fail if another build changed
+	// the lease in the meantime
+	patch := lease{}
+	patch.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+	patch.Metadata.Annotations = map[string]string{lockBuildAnnotation: h.Lock.Holder}
+	patch.Spec = h.newLease(now).Spec
+	if holder == h.Lock.Holder && current.Spec.AcquireTime != nil {
+		patch.Spec.AcquireTime = current.Spec.AcquireTime
+	}
+	err = h.patchLease(ctx, patch)
+	if err != nil && strings.Contains(commandOutput(err), "Conflict") {
+		return false, "another build", nil
+	} else if err != nil {
+		return false, "", fmt.Errorf("unable to update lease: %s", err)
+	}
+	return true, "", nil
+}
+
+// unlock clears the holder of the lease if it is still held by this build
+func (h *HelmCmd) unlock(ctx context.Context) error {
+	current, err := h.getLease(ctx)
+	if err != nil || current == nil {
+		return err
+	}
+	if current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != h.Lock.Holder {
+		return fmt.Errorf("lease was taken over by another build")
+	}
+	patch := lease{}
+	patch.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+	return h.patchLease(ctx, patch)
+}
+
+// expired reports if the holder did not renew the lease in time
+func (h *HelmCmd) expired(current *lease) bool {
+	if current.Spec.RenewTime == nil {
+		return true
+	}
+	renewed, err := time.Parse(lockTimeFormat, *current.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	duration := time.Duration(current.Spec.LeaseDurationSeconds) * time.Second
+	return h.Lock.now().After(renewed.Add(duration))
+}
+
+// newLease returns the lease held by this build
+func (h *HelmCmd) newLease(now string) *lease {
+	created := &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+	created.Metadata.Name = lockPrefix + h.Release
+	created.Metadata.Namespace = h.Namespace
+	created.Metadata.Annotations = map[string]string{lockBuildAnnotation: h.Lock.Holder}
+	holder := h.Lock.Holder
+	created.Spec = leaseSpec{
+		HolderIdentity:       &holder,
+		LeaseDurationSeconds: int(h.Lock.Duration.Seconds()),
+		AcquireTime:          &now,
+		RenewTime:            &now,
+	}
+	return created
+}
+
+// getLease returns the lease of the release, nil if it does not exist
+func (h *HelmCmd) getLease(ctx context.Context) (*lease, error) {
+	args := append([]string{"get", "lease", lockPrefix + h.Release, "-o", "json"}, h.connArgs()...)
+	out, err := h.Runner.Output(ctx, "kubectl", args...)
+	if err != nil && strings.Contains(commandOutput(err), "NotFound") {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to get lease: %s", err)
+	}
+	current := &lease{}
+	err = json.Unmarshal(out, current)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse lease: %s", err)
+	}
+	return current, nil
+}
+
+func (h *HelmCmd) patchLease(ctx context.Context, patch lease) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": patch.Metadata,
+		"spec":     patch.Spec,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to render lease patch: %s", err)
+	}
+	args := append([]string{"patch", "lease", lockPrefix + h.Release, "--type", "merge", "-p", string(data)}, h.connArgs()...)
+	return h.Runner.Run(ctx, "kubectl", args...)
+}
+
+// commandOutput returns the captured error output of a command
+func commandOutput(err error) string {
+	if cmdErr, ok := err.(*CommandError); ok {
+		return cmdErr.Stderr
+	}
+	return err.Error()
+}
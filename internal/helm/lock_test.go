@@ -0,0 +1,166 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+)
+
+func TestLock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	now := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	conn := []interface{}{"-n", "foo", "--kubeconfig", "/root/.kube/config"}
+	notFound := &CommandError{
+		Err:    fmt.Errorf("exit status 1"),
+		Stderr: `Error from server (NotFound): leases.coordination.k8s.io "drone-helm3-foo" not found`,
+	}
+	expectGet := func(out string, err error) {
+		args := append([]interface{}{"get", "lease", "drone-helm3-foo", "-o", "json"}, conn...)
+		mockRunner.EXPECT().Output(gomock.Any(), "kubectl", args...).Return([]byte(out), err)
+	}
+	expectPatch := func(patch string) {
+		args := append([]interface{}{"patch", "lease", "drone-helm3-foo", "--type", "merge", "-p", patch}, conn...)
+		mockRunner.EXPECT().Run(gomock.Any(), "kubectl", args...)
+	}
+	expectUnlock := func() {
+		expectGet(`{"metadata": {"resourceVersion": "8"}, "spec": {"holderIdentity": "https://drone/me/2"}}`, nil)
+		expectPatch(`{"metadata":{"resourceVersion":"8"},"spec":{"holderIdentity":null,"renewTime":null}}`)
+	}
+	expectUpgrade := func() {
+		// the run context is cancelled if the lock is lost
+		mockRunner.EXPECT().Run(
+			gomock.Any(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		)
+	}
+
+	tests := []struct {
+		name   string
+		setup  func()
+		runErr error
+	}{
+		{
+			name: "create lease",
+			setup: func() {
+				expectGet("", notFound)
+				args := append([]interface{}{"create", "-f", "-"}, conn...)
+				mockRunner.EXPECT().RunWithStdin(gomock.Any(), readerEq(`{"apiVersion":"coordination.k8s.io/v1","kind":"Lease",`+
+					`"metadata":{"name":"drone-helm3-foo","namespace":"foo","annotations":{"drone-helm3/build-link":"https://drone/me/2"}},`+
+					`"spec":{"holderIdentity":"https://drone/me/2","leaseDurationSeconds":60,`+
+					`"acquireTime":"2021-01-01T10:00:00.000000Z","renewTime":"2021-01-01T10:00:00.000000Z"}}`), "kubectl", args...)
+				expectUpgrade()
+				expectUnlock()
+			},
+		},
+		{
+			name: "held by another build",
+			setup: func() {
+				expectGet(`{"metadata": {"resourceVersion": "7"}, "spec": {"holderIdentity": "https://drone/other/1",
+					"leaseDurationSeconds": 60, "renewTime": "2021-01-01T09:59:30.000000Z"}}`, nil)
+			},
+			runErr: fmt.Errorf("unable to acquire lock: release foo is locked by https://drone/other/1"),
+		},
+		{
+			name: "take over expired lease",
+			setup: func() {
+				expectGet(`{"metadata": {"resourceVersion": "7"}, "spec": {"holderIdentity": "https://drone/other/1",
+					"leaseDurationSeconds": 60, "renewTime": "2021-01-01T09:58:00.000000Z"}}`, nil)
+				expectPatch(`{"metadata":{"resourceVersion":"7","annotations":{"drone-helm3/build-link":"https://drone/me/2"}},` +
+					`"spec":{"holderIdentity":"https://drone/me/2","leaseDurationSeconds":60,` +
+					`"acquireTime":"2021-01-01T10:00:00.000000Z","renewTime":"2021-01-01T10:00:00.000000Z"}}`)
+				expectUpgrade()
+				expectUnlock()
+			},
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			WithLock(Lock{
+				Enabled: true,
+				Holder:  "https://drone/me/2",
+				now:     func() time.Time { return now },
+			}),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		test.setup()
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	now := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	conn := []interface{}{"-n", "foo", "--kubeconfig", "/root/.kube/config"}
+	takenOver := `{"metadata": {"resourceVersion": "9"}, "spec": {"holderIdentity": "https://drone/other/1",
+		"leaseDurationSeconds": 60, "renewTime": "2021-01-01T10:00:00.000000Z"}}`
+	get := append([]interface{}{"get", "lease", "drone-helm3-foo", "-o", "json"}, conn...)
+
+	gomock.InOrder(
+		mockRunner.EXPECT().Output(gomock.Any(), "kubectl", get...).Return(nil, &CommandError{
+			Err:    fmt.Errorf("exit status 1"),
+			Stderr: `Error from server (NotFound): leases.coordination.k8s.io "drone-helm3-foo" not found`,
+		}),
+		mockRunner.EXPECT().RunWithStdin(gomock.Any(), gomock.Any(), "kubectl", append([]interface{}{"create", "-f", "-"}, conn...)...),
+		mockRunner.EXPECT().Output(
+			gomock.Any(),
+			"helm", "list", "--all", "--filter", "^foo$", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return([]byte("[]"), nil),
+		// the upgrade runs until the renewal finds the lease taken over, the
+		// release is not uninstalled since it belongs to the other build now
+		mockRunner.EXPECT().Run(
+			gomock.Any(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		).DoAndReturn(func(ctx context.Context, _ string, _ ...string) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	)
+	mockRunner.EXPECT().Output(gomock.Any(), "kubectl", get...).Return([]byte(takenOver), nil).Times(2)
+
+	cmd, err := NewHelmCmd(
+		WithInstallUpgradeMode(),
+		WithRelease("foo"),
+		WithNamespace("foo"),
+		WithKubeConfig("/root/.kube/config"),
+		WithChart("chart"),
+		WithLock(Lock{
+			Enabled:  true,
+			Holder:   "https://drone/me/2",
+			Duration: 30 * time.Millisecond,
+			now:      func() time.Time { return now },
+		}),
+		WithCancelCleanup(CancelCleanupRollback, time.Second),
+		WithRunner(mockRunner),
+	)
+	if err != nil {
+		t.Fatalf("unable to create helm cmd: %s", err)
+	}
+	err = cmd.Run(context.Background())
+	want := fmt.Errorf("lock lost: taken over by https://drone/other/1")
+	if !errEq(err, want) {
+		t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", want, err)
+	}
+}
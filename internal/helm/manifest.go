@@ -0,0 +1,59 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// manifestResource is a kubernetes resource of the release manifest
+	manifestResource struct {
+		Kind      string
+		Name      string
+		Namespace string
+		Object    map[string]interface{}
+	}
+)
+
+var manifestSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// parseManifest parses a multi document yaml manifest, empty documents are
+// skipped
+func parseManifest(manifest []byte) ([]manifestResource, error) {
+	resources := []manifestResource{}
+	for i, doc := range manifestSeparator.Split(string(manifest), -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		object := map[string]interface{}{}
+		err := yaml.Unmarshal([]byte(doc), &object)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse manifest document %d: %s", i, err)
+		}
+		if len(object) == 0 {
+			continue
+		}
+		resource := manifestResource{Object: object}
+		resource.Kind, _ = object["kind"].(string)
+		if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+			resource.Name, _ = metadata["name"].(string)
+			resource.Namespace, _ = metadata["namespace"].(string)
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// manifest returns the resources of the deployed release
+func (h *HelmCmd) manifest(ctx context.Context) ([]manifestResource, error) {
+	args := append([]string{"get", "manifest", h.Release}, h.connArgs()...)
+	out, err := h.query(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get release manifest: %s", err)
+	}
+	return parseManifest(out)
+}
@@ -0,0 +1,224 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// PackageOptions configures the package mode
+	PackageOptions struct {
+		Version     string
+		AppVersion  string
+		Destination string
+		Sign        bool
+		Push        string
+	}
+
+	// chartMetadata is the subset of a Chart.yaml required for packaging
+	chartMetadata struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+)
+
+const PackageMode HelmMode = "package"
+
+func WithPackageMode() HelmModeOption {
+	return func(c *HelmCmd) {
+		c.Mode = PackageMode
+		c.Args = append([]string{"package"}, c.Args...)
+	}
+}
+
+// WithPackageVersion overrides the version and app version of the packaged
+// chart, empty values keep the ones from the Chart.yaml
+func WithPackageVersion(version, appVersion string) HelmOption {
+	return func(c *HelmCmd) error {
+		if version != "" {
+			c.Package.Version = version
+			c.Args = append(c.Args, "--version", version)
+		}
+		if appVersion != "" {
+			c.Package.AppVersion = appVersion
+			c.Args = append(c.Args, "--app-version", appVersion)
+		}
+		return nil
+	}
+}
+
+func WithPackageDestination(dir string) HelmOption {
+	return func(c *HelmCmd) error {
+		if dir != "" {
+			c.Package.Destination = dir
+			c.Args = append(c.Args, "--destination", dir)
+		}
+		return nil
+	}
+}
+
+// WithPackageSign signs the package with the key from the keyring, the
+// passphrase is passed via stdin
+func WithPackageSign(key, keyring, passphrase string) HelmOption {
+	return func(c *HelmCmd) error {
+		if key == "" {
+			return nil
+		}
+		if keyring == "" {
+			return fmt.Errorf("signing requires a keyring")
+		}
+		c.Package.Sign = true
+		c.Args = append(c.Args, "--sign", "--key", key, "--keyring", keyring)
+		if passphrase != "" {
+			c.Args = append(c.Args, "--passphrase-file", "-")
+			c.Stdin = passphrase
+		}
+		return nil
+	}
+}
+
+// WithPackagePush pushes the package to an oci:// registry or uploads it to
+// a ChartMuseum compatible http(s):// endpoint
+func WithPackagePush(target string) HelmOption {
+	return func(c *HelmCmd) error {
+		if target == "" {
+			return nil
+		}
+		if !IsOCI(target) && !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+			return fmt.Errorf("push target must be an oci:// or http(s):// url: %s", target)
+		}
+		c.Package.Push = target
+		return nil
+	}
+}
+
+// packageFile returns the path of the chart archive created by helm package
+func (h *HelmCmd) packageFile() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(h.Chart, "Chart.yaml"))
+	if err != nil {
+		return "", fmt.Errorf("unable to read chart metadata: %s", err)
+	}
+	metadata := &chartMetadata{}
+	err = yaml.Unmarshal(data, metadata)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse chart metadata: %s", err)
+	}
+	version := metadata.Version
+	if h.Package.Version != "" {
+		version = h.Package.Version
+	}
+	file := fmt.Sprintf("%s-%s.tgz", metadata.Name, version)
+	return filepath.Join(h.Package.Destination, file), nil
+}
+
+// pushCommand returns the command that publishes the chart archive
+func (h *HelmCmd) pushCommand() (Command, error) {
+	file, err := h.packageFile()
+	if err != nil {
+		return Command{}, err
+	}
+	if IsOCI(h.Package.Push) {
+		args := []string{"helm", "push", file, h.Package.Push}
+		if h.RegistryLogin.CAFile != "" {
+			args = append(args, "--ca-file", h.RegistryLogin.CAFile)
+		}
+		if h.RegistryLogin.Insecure {
+			args = append(args, "--insecure-skip-tls-verify")
+		}
+		return Command{Phase: PhasePush, Args: args}, nil
+	}
+	return Command{
+		Phase: PhasePush,
+		Args:  []string{"upload", file, h.Package.Push},
+		Func: func(ctx context.Context) error {
+			return upload(ctx, h.Package.Push, file, h.Package.Sign, h.RegistryLogin)
+		},
+	}, nil
+}
+
+// upload posts the chart archive and its provenance file as multipart form
+// to a ChartMuseum compatible endpoint
+func upload(ctx context.Context, url, file string, prov bool, login RegistryLogin) error {
+	log.Printf("uploading %s to %s", file, url)
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	fields := [][2]string{{"chart", file}}
+	if prov {
+		fields = append(fields, [2]string{"prov", file + ".prov"})
+	}
+	for _, field := range fields {
+		name, path := field[0], field[1]
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("unable to open %s: %s", path, err)
+		}
+		part, err := form.CreateFormFile(name, filepath.Base(path))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to add %s to upload: %s", path, err)
+		}
+	}
+	err := form.Close()
+	if err != nil {
+		return fmt.Errorf("unable to create upload: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return fmt.Errorf("unable to create upload request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if login.Username != "" {
+		req.SetBasicAuth(login.Username, login.Password)
+	}
+
+	client, err := httpClient(login)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to upload chart: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unable to upload chart, status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func httpClient(login RegistryLogin) (*http.Client, error) {
+	if login.CAFile == "" && !login.Insecure {
+		return http.DefaultClient, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: login.Insecure}
+	if login.CAFile != "" {
+		ca, err := ioutil.ReadFile(login.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca file: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", login.CAFile)
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}, nil
+}
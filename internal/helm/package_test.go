@@ -0,0 +1,169 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+)
+
+func TestPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-helm3")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	chart := filepath.Join(dir, "myapp")
+	dist := filepath.Join(dir, "dist")
+	for _, d := range []string{chart, dist} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatalf("unable to create dir: %s", err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(chart, "Chart.yaml"), []byte("name: myapp\nversion: 0.1.0\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write chart: %s", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dist, "myapp-1.2.3.tgz"), []byte("chart"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write package: %s", err)
+	}
+
+	uploaded := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f, header, err := r.FormFile("chart")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		data, _ := ioutil.ReadAll(f)
+		uploaded = fmt.Sprintf("%s:%s", header.Filename, data)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	tests := []struct {
+		name      string
+		options   []HelmOption
+		setup     func()
+		createErr error
+		runErr    error
+	}{
+		{
+			name: "package and push to oci registry",
+			options: []HelmOption{
+				WithChart(chart),
+				WithLint(true),
+				WithPackageVersion("1.2.3", "1.2.3"),
+				WithPackageDestination(dist),
+				WithPackageSign("deploy", "/root/.gnupg/secring.gpg", "passphrase"),
+				WithPackagePush("oci://registry.example.com/charts"),
+				WithRegistryLogin(RegistryLogin{Username: "user", Password: "secret"}),
+				WithRunner(mockRunner),
+			},
+			setup: func() {
+				mockRunner.EXPECT().RunWithStdin(
+					context.Background(), readerEq("secret"),
+					"helm", "registry", "login", "registry.example.com",
+					"--username", "user", "--password-stdin",
+				)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "lint", chart,
+				)
+				mockRunner.EXPECT().RunWithStdin(
+					context.Background(), readerEq("passphrase"),
+					"helm", "package", "--version", "1.2.3", "--app-version", "1.2.3",
+					"--destination", dist,
+					"--sign", "--key", "deploy", "--keyring", "/root/.gnupg/secring.gpg",
+					"--passphrase-file", "-", chart,
+				)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "push", filepath.Join(dist, "myapp-1.2.3.tgz"), "oci://registry.example.com/charts",
+				)
+			},
+		},
+		{
+			name: "package and upload to chartmuseum",
+			options: []HelmOption{
+				WithChart(chart),
+				WithPackageVersion("1.2.3", "1.2.3"),
+				WithPackageDestination(dist),
+				WithPackagePush(server.URL + "/api/charts"),
+				WithRegistryLogin(RegistryLogin{Username: "user", Password: "secret"}),
+				WithRunner(mockRunner),
+			},
+			setup: func() {
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "package", "--version", "1.2.3", "--app-version", "1.2.3",
+					"--destination", dist, chart,
+				)
+			},
+		},
+		{
+			name: "package and upload with wrong credentials",
+			options: []HelmOption{
+				WithChart(chart),
+				WithPackageVersion("1.2.3", "1.2.3"),
+				WithPackageDestination(dist),
+				WithPackagePush(server.URL + "/api/charts"),
+				WithRunner(mockRunner),
+			},
+			setup: func() {
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "package", "--version", "1.2.3", "--app-version", "1.2.3",
+					"--destination", dist, chart,
+				)
+			},
+			runErr: fmt.Errorf("postcmd failed: unable to upload chart, status 401: "),
+		},
+		{
+			name: "package with invalid push target",
+			options: []HelmOption{
+				WithChart(chart),
+				WithPackagePush("ftp://example.com"),
+				WithRunner(mockRunner),
+			},
+			createErr: fmt.Errorf("unable to parse option: push target must be an oci:// or http(s):// url: ftp://example.com"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		cmd, err := NewHelmCmd(WithPackageMode(), test.options...)
+		if !errEq(err, test.createErr) {
+			t.Fatalf("unable to create helm cmd:\n- %v\n+ %v", test.createErr, err)
+		} else if err != nil {
+			continue
+		}
+		test.setup()
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+	}
+
+	if uploaded != "myapp-1.2.3.tgz:chart" {
+		t.Fatalf("unexpected upload: %q", uploaded)
+	}
+}
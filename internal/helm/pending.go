@@ -0,0 +1,56 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bitsbeats/drone-helm3/internal/core"
+)
+
+// WithRecoverPending rolls back or uninstalls a release that is stuck in a
+// pending state before the upgrade
+func WithRecoverPending(recover bool) HelmOption {
+	return func(c *HelmCmd) error {
+		c.RecoverPending = recover
+		return nil
+	}
+}
+
+// recoverPending checks the status of the release and recovers it if an
+// interrupted operation left it pending, the action taken is stored in
+// Recovered
+func (h *HelmCmd) recoverPending(ctx context.Context) error {
+	status, err := h.status(ctx)
+	if err != nil && strings.Contains(commandOutput(err), "release: not found") {
+		// the release does not exist yet, there is nothing to recover
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get release status: %s", err)
+	}
+	if !strings.HasPrefix(status.Info.Status, "pending-") {
+		return nil
+	}
+	log.Printf("release %s is %s at revision %d", h.Release, status.Info.Status, status.Version)
+
+	revision, err := h.lastDeployed(ctx)
+	if err != nil {
+		return err
+	}
+	if revision == 0 {
+		log.Printf("release %s has no deployed revision", h.Release)
+	}
+	action, err := h.restore(ctx, &rollbackTarget{Revision: revision})
+	if err != nil {
+		err = fmt.Errorf("unable to %s: %s", action, err)
+		h.fireRollback(ctx, err, Wrap(err, "unable to recover pending release", core.RollbackFailedErrorKind))
+		return err
+	}
+	h.Recovered = action
+	log.Printf("recovered %s release %s via %s", status.Info.Status, h.Release, h.Recovered)
+	recovered := fmt.Errorf("release was %s", status.Info.Status)
+	h.fireRollback(ctx, nil, Wrap(recovered, fmt.Sprintf("pending release recovered and %s successful", action), core.RollbackSuccessErrorKind))
+	return nil
+}
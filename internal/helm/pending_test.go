@@ -0,0 +1,194 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecoverPending(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	expectStatus := func(status string, err error) {
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "status", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return([]byte(fmt.Sprintf(`{"version": 3, "info": {"status": %q}}`, status)), err)
+	}
+	expectHistory := func(history string) {
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "history", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return([]byte(history), nil)
+	}
+	expectUpgrade := func() {
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		)
+	}
+
+	tests := []struct {
+		name      string
+		setup     func()
+		runErr    error
+		recovered string
+		hooks     []string
+	}{
+		{
+			name: "deployed release",
+			setup: func() {
+				expectStatus("deployed", nil)
+				expectUpgrade()
+			},
+		},
+		{
+			name: "new release",
+			setup: func() {
+				expectStatus("", fmt.Errorf("release: not found"))
+				expectUpgrade()
+			},
+		},
+		{
+			name: "status failed",
+			setup: func() {
+				expectStatus("", fmt.Errorf("forbidden"))
+			},
+			runErr: fmt.Errorf("unable to recover pending release: unable to get release status: forbidden"),
+		},
+		{
+			name: "pending upgrade",
+			setup: func() {
+				expectStatus("pending-upgrade", nil)
+				expectHistory(`[{"revision": 1, "status": "superseded"}, {"revision": 2, "status": "deployed"}, {"revision": 3, "status": "pending-upgrade"}]`)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "rollback", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "2",
+				)
+				expectStatus("deployed", nil)
+				expectUpgrade()
+			},
+			recovered: "rollback",
+			hooks:     []string{"rollback_success: pending release recovered and rollback successful: release was pending-upgrade"},
+		},
+		{
+			name: "pending install",
+			setup: func() {
+				expectStatus("pending-install", nil)
+				expectHistory(`[{"revision": 1, "status": "pending-install"}]`)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "uninstall", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config",
+				)
+				expectStatus("", fmt.Errorf("release: not found"))
+				expectUpgrade()
+			},
+			recovered: "uninstall",
+			hooks:     []string{"rollback_success: pending release recovered and uninstall successful: release was pending-install"},
+		},
+		{
+			name: "failed recovery",
+			setup: func() {
+				expectStatus("pending-install", nil)
+				expectHistory(`[{"revision": 1, "status": "pending-install"}]`)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "uninstall", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config",
+				).Return(fmt.Errorf("forbidden"))
+				expectStatus("pending-install", nil)
+			},
+			runErr: fmt.Errorf("unable to recover pending release: unable to uninstall: forbidden"),
+			hooks:  []string{"rollback_failed: unable to recover pending release: unable to uninstall: forbidden"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		var hooks []string
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			WithRecoverPending(true),
+			WithOnRollback(func(ctx context.Context, outcome *Outcome) error {
+				hooks = append(hooks, fmt.Sprintf("%s: %s", outcome.Kind(), outcome.Err))
+				return nil
+			}),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		test.setup()
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+		if cmd.Recovered != test.recovered {
+			t.Fatalf("unexpected recovery:\n- %s\n+ %s", test.recovered, cmd.Recovered)
+		}
+		if diff := cmp.Diff(test.hooks, hooks); diff != "" {
+			t.Fatalf("unexpected hooks:\n%s", diff)
+		}
+	}
+}
+
+func TestRecoverPendingBeforeManifestChecks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	cmd, err := NewHelmCmd(
+		WithInstallUpgradeMode(),
+		WithRelease("foo"),
+		WithNamespace("foo"),
+		WithKubeConfig("/root/.kube/config"),
+		WithChart("chart"),
+		WithRecoverPending(true),
+		WithManifestChecks(ManifestChecks{Rules: map[string]Severity{"latest-tag": SeverityDeny}}),
+		WithRunner(mockRunner),
+	)
+	if err != nil {
+		t.Fatalf("unable to create helm cmd: %s", err)
+	}
+
+	// helm refuses the dry run until the pending release is rolled back
+	gomock.InOrder(
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "status", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return([]byte(`{"version": 2, "info": {"status": "pending-upgrade"}}`), nil),
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "history", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return([]byte(`[{"revision": 1, "status": "deployed"}, {"revision": 2, "status": "pending-upgrade"}]`), nil),
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "rollback", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "1",
+		),
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "--dry-run", "--output", "json", "foo", "chart",
+		).Return([]byte(`{"name": "foo", "manifest": ""}`), nil),
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		),
+	)
+
+	err = cmd.Run(context.Background())
+	if err != nil {
+		t.Fatalf("unable to run helm cmd: %s", err)
+	}
+	if cmd.Recovered != "rollback" {
+		t.Fatalf("unexpected recovery: %s", cmd.Recovered)
+	}
+}
@@ -0,0 +1,131 @@
+package helm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bitsbeats/drone-helm3/internal/redact"
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// HelmRepo is a chart repository added via `helm repo add`
+	HelmRepo struct {
+		Name            string `json:"name"`
+		URL             string `json:"url"`
+		Username        string `json:"username"`
+		Password        string `json:"password"`
+		CAFile          string `json:"ca_file"`
+		Insecure        bool   `json:"insecure"`
+		PassCredentials bool   `json:"pass_credentials"`
+	}
+)
+
+// ParseHelmRepos parses the repository specification, either a comma
+// separated list of name=url pairs or a YAML/JSON list whose items are
+// name=url strings or repository objects
+func ParseHelmRepos(spec string) ([]HelmRepo, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(spec, "[") && !strings.HasPrefix(spec, "-") {
+		return parseLegacyHelmRepos(strings.Split(spec, ","))
+	}
+
+	items := []json.RawMessage{}
+	err := yaml.Unmarshal([]byte(spec), &items)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse helm repos: %s", err)
+	}
+	repos := make([]HelmRepo, 0, len(items))
+	for _, item := range items {
+		legacy := ""
+		if json.Unmarshal(item, &legacy) == nil {
+			parsed, err := parseLegacyHelmRepos([]string{legacy})
+			if err != nil {
+				return nil, err
+			}
+			repos = append(repos, parsed...)
+			continue
+		}
+		repo := HelmRepo{}
+		err := json.Unmarshal(item, &repo)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse helm repo: %s", err)
+		}
+		if repo.Name == "" || repo.URL == "" {
+			return nil, fmt.Errorf("helm repo requires name and url: %s", item)
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+func parseLegacyHelmRepos(specs []string) ([]HelmRepo, error) {
+	repos := make([]HelmRepo, 0, len(specs))
+	for _, spec := range specs {
+		split := strings.SplitN(spec, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("not in key=value format: %s", spec)
+		}
+		repos = append(repos, HelmRepo{Name: split[0], URL: split[1]})
+	}
+	return repos, nil
+}
+
+// Masked returns a copy of the repository with the password and the
+// credentials of the url masked, used for logs and debug output
+func (r HelmRepo) Masked() HelmRepo {
+	if r.Password != "" {
+		r.Password = "***"
+	}
+	r.URL = redact.URL(r.URL)
+	return r
+}
+
+// entry returns the repository as written by `helm repo add`
+func (r HelmRepo) entry() repoEntry {
+	return repoEntry{
+		Name:            r.Name,
+		URL:             r.URL,
+		Username:        r.Username,
+		Password:        r.Password,
+		CAFile:          r.CAFile,
+		Insecure:        r.Insecure,
+		PassCredentials: r.PassCredentials,
+	}
+}
+
+// command returns the `helm repo add` command, the password is passed via
+// stdin to keep it out of the process list and logs
+func (r HelmRepo) command() Command {
+	args := []string{"helm", "repo", "add", r.Name, r.URL}
+	if r.Username != "" {
+		args = append(args, "--username", r.Username)
+	}
+	if r.Password != "" {
+		args = append(args, "--password-stdin")
+	}
+	if r.CAFile != "" {
+		args = append(args, "--ca-file", r.CAFile)
+	}
+	if r.Insecure {
+		args = append(args, "--insecure-skip-tls-verify")
+	}
+	if r.PassCredentials {
+		args = append(args, "--pass-credentials")
+	}
+	return Command{Phase: PhaseRepoAdd, Args: args, Stdin: r.Password}
+}
+
+// repo returns the repository of HELM_REPOS with the name
+func (h *HelmCmd) repo(name string) (HelmRepo, bool) {
+	for _, repo := range h.Repos {
+		if repo.Name == name {
+			return repo, true
+		}
+	}
+	return HelmRepo{}, false
+}
@@ -0,0 +1,147 @@
+package helm
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"time"
+)
+
+type (
+	// CommandError is returned by a Runner if a command failed, Stderr is
+	// the captured error output used to classify the error
+	CommandError struct {
+		Err    error
+		Stderr string
+	}
+
+	// Retry configures the retries of transient errors
+	Retry struct {
+		// Attempts is the maximum number of attempts, 0 or 1 disable retries
+		Attempts int
+
+		// Backoff is the wait before the first retry, it doubles with each
+		// retry up to maxBackoff
+		Backoff time.Duration
+
+		// Upgrade also retries the helm upgrade, helm upgrades are not
+		// strictly idempotent
+		Upgrade bool
+	}
+
+	transientPattern struct {
+		reason  string
+		pattern *regexp.Regexp
+	}
+)
+
+// PhaseStatus identifies queries of the release state like `helm status`
+const PhaseStatus Phase = "status"
+
+const maxBackoff = 30 * time.Second
+
+// retryPhases are idempotent and retried on transient errors
+var retryPhases = map[Phase]bool{
+	PhaseRegistryLogin:    true,
+	PhaseRepoAdd:          true,
+	PhaseRepoUpdate:       true,
+	PhaseDependencyBuild:  true,
+	PhaseDependencyUpdate: true,
+	PhaseStatus:           true,
+	PhaseRender:           true,
+	PhaseVerify:           true,
+}
+
+// transientPatterns match error output of temporary cluster and network
+// problems
+var transientPatterns = []transientPattern{
+	{"connection refused", regexp.MustCompile(`(?i)connection refused`)},
+	{"connection reset", regexp.MustCompile(`(?i)connection reset by peer`)},
+	{"timeout", regexp.MustCompile(`(?i)i/o timeout|TLS handshake timeout|Client\.Timeout exceeded|net/http: request canceled while waiting for connection`)},
+	{"etcd leader change", regexp.MustCompile(`etcdserver: (leader changed|request timed out|no leader)`)},
+	{"server unavailable", regexp.MustCompile(`(?i)the server is currently unable to handle the request|the server was unable to return a response|http2: server sent GOAWAY`)},
+	{"server error", regexp.MustCompile(`(?i)internal server error|bad gateway|service unavailable|gateway timeout`)},
+	{"rate limited", regexp.MustCompile(`(?i)too many requests`)},
+	{"dns", regexp.MustCompile(`(?i)temporary failure in name resolution|server misbehaving`)},
+	{"unexpected eof", regexp.MustCompile(`unexpected EOF`)},
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+// WithRetry retries transient errors of idempotent phases
+func WithRetry(retry Retry) HelmOption {
+	return func(c *HelmCmd) error {
+		c.Retry = retry
+		return nil
+	}
+}
+
+// Classify reports if err is transient, the reason names the matching
+// error class
+func Classify(err error) (bool, string) {
+	output := err.Error()
+	if cmdErr, ok := err.(*CommandError); ok {
+		output = cmdErr.Stderr + "\n" + cmdErr.Error()
+	}
+	for _, transient := range transientPatterns {
+		if transient.pattern.MatchString(output) {
+			return true, transient.reason
+		}
+	}
+	return false, "permanent"
+}
+
+// retries reports if transient errors of the phase are retried
+func (h *HelmCmd) retries(phase Phase) bool {
+	if h.Retry.Attempts <= 1 {
+		return false
+	}
+	return retryPhases[phase] || (phase == PhaseUpgrade && h.Retry.Upgrade)
+}
+
+// retry calls fn until it succeeds, fails permanently, the attempts are used
+// up or ctx is done
+func (h *HelmCmd) retry(ctx context.Context, phase Phase, fn func() error) error {
+	backoff := h.Retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !h.retries(phase) {
+			return err
+		}
+		transient, reason := Classify(err)
+		switch {
+		case !transient:
+			log.Printf("%s failed with a permanent error, not retrying: %s", phase, err)
+			return err
+		case attempt >= h.Retry.Attempts:
+			log.Printf("%s failed with a transient error (%s), giving up after %d attempts", phase, reason, attempt)
+			return err
+		case ctx.Err() != nil:
+			return err
+		}
+		log.Printf("%s failed with a transient error (%s), retrying in %s (attempt %d/%d)", phase, reason, backoff, attempt+1, h.Retry.Attempts)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// query runs a read only helm command and returns its output, transient
+// errors are retried
+func (h *HelmCmd) query(ctx context.Context, args ...string) ([]byte, error) {
+	var out []byte
+	err := h.retry(ctx, PhaseStatus, func() error {
+		var err error
+		out, err = h.Runner.Output(ctx, "helm", args...)
+		return err
+	})
+	return out, err
+}
@@ -0,0 +1,146 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+		reason    string
+	}{
+		{
+			err:       &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: Kubernetes cluster unreachable: Get \"https://10.0.0.1:6443/version\": dial tcp 10.0.0.1:6443: connect: connection refused"},
+			transient: true,
+			reason:    "connection refused",
+		},
+		{
+			err:       &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: UPGRADE FAILED: etcdserver: leader changed"},
+			transient: true,
+			reason:    "etcd leader change",
+		},
+		{
+			err:       &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: net/http: TLS handshake timeout"},
+			transient: true,
+			reason:    "timeout",
+		},
+		{
+			err:       &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: looks like \"https://charts.example.com\" is not a valid chart repository or cannot be reached: failed to fetch https://charts.example.com/index.yaml : 503 Service Unavailable"},
+			transient: true,
+			reason:    "server error",
+		},
+		{
+			err:       fmt.Errorf("unable to upload chart: Post \"https://charts.example.com\": dial tcp: lookup charts.example.com: Temporary failure in name resolution"),
+			transient: true,
+			reason:    "dns",
+		},
+		{
+			err:    &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: UPGRADE FAILED: template: app/templates/deployment.yaml:12: function \"foo\" not defined"},
+			reason: "permanent",
+		},
+		{
+			err:    &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: failed to fetch https://charts.example.com/index.yaml : 404 Not Found"},
+			reason: "permanent",
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.err)
+		transient, reason := Classify(test.err)
+		if transient != test.transient || reason != test.reason {
+			t.Fatalf("unexpected classification: %t %s", transient, reason)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	transientErr := &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: connection reset by peer"}
+	permanentErr := &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: no repositories found"}
+
+	expectRepoUpdate := func(errs ...error) {
+		for _, err := range errs {
+			mockRunner.EXPECT().Run(context.Background(), "helm", "repo", "update").Return(err)
+		}
+	}
+	expectUpgrade := func(errs ...error) {
+		for _, err := range errs {
+			mockRunner.EXPECT().Run(context.Background(), "helm", "upgrade", "--install", "foo", "chart").Return(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		upgrade bool
+		setup   func()
+		runErr  error
+	}{
+		{
+			name: "transient repo update error is retried",
+			setup: func() {
+				expectRepoUpdate(transientErr, transientErr, nil)
+				expectUpgrade(nil)
+			},
+		},
+		{
+			name: "attempts are limited",
+			setup: func() {
+				expectRepoUpdate(transientErr, transientErr, transientErr)
+			},
+			runErr: fmt.Errorf("precmd failed: exit status 1"),
+		},
+		{
+			name: "permanent error is not retried",
+			setup: func() {
+				expectRepoUpdate(permanentErr)
+			},
+			runErr: fmt.Errorf("precmd failed: exit status 1"),
+		},
+		{
+			name: "upgrade is not retried by default",
+			setup: func() {
+				expectRepoUpdate(nil)
+				expectUpgrade(transientErr)
+			},
+			runErr: fmt.Errorf("helm failed: exit status 1"),
+		},
+		{
+			name:    "upgrade is retried if enabled",
+			upgrade: true,
+			setup: func() {
+				expectRepoUpdate(nil)
+				expectUpgrade(transientErr, nil)
+			},
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithChart("chart"),
+			WithRetry(Retry{Attempts: 3, Backoff: time.Millisecond, Upgrade: test.upgrade}),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		cmd.PreCmds = append(cmd.PreCmds, Command{Phase: PhaseRepoUpdate, Args: []string{"helm", "repo", "update"}})
+		test.setup()
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+	}
+}
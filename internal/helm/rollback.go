@@ -0,0 +1,159 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/bitsbeats/drone-helm3/internal/core"
+)
+
+type (
+	// releaseRevision is an entry of `helm history -o json` or `helm list -o json`
+	releaseRevision struct {
+		Revision int    `json:"revision"`
+		Status   string `json:"status"`
+	}
+
+	// rollbackTarget is the state to recover to if the deployment fails
+	rollbackTarget struct {
+		// Revision is the last deployed revision, 0 if the release has never
+		// been deployed and has to be uninstalled
+		Revision int
+	}
+)
+
+// WithRollbackOnFailure rolls back to the last deployed revision, or
+// uninstalls a first install, if anything fails after the upgrade started
+func WithRollbackOnFailure(rollback bool) HelmOption {
+	return func(c *HelmCmd) error {
+		c.RollbackOnFailure = rollback
+		return nil
+	}
+}
+
+// recovers reports if failures after the upgrade started are recovered
+func (h *HelmCmd) recovers() bool {
+	return h.RollbackOnFailure && h.Mode == InstallUpgradeMode
+}
+
+// rollbackTarget determines the revision to roll back to before the upgrade
+// changes the release history
+func (h *HelmCmd) rollbackTarget(ctx context.Context) (*rollbackTarget, error) {
+	args := append([]string{"list", "--all", "--filter", fmt.Sprintf("^%s$", h.Release)}, h.connArgs()...)
+	args = append(args, "-o", "json")
+	out, err := h.query(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list releases: %s", err)
+	}
+	releases := []releaseRevision{}
+	err = json.Unmarshal(out, &releases)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse release list: %s", err)
+	}
+	if len(releases) == 0 {
+		log.Printf("release %s does not exist yet, it will be uninstalled on failure", h.Release)
+		return &rollbackTarget{}, nil
+	}
+
+	revision, err := h.lastDeployed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	target := &rollbackTarget{Revision: revision}
+	if target.Revision == 0 {
+		log.Printf("release %s has no deployed revision, it will be uninstalled on failure", h.Release)
+	} else {
+		log.Printf("release %s will be rolled back to revision %d on failure", h.Release, target.Revision)
+	}
+	return target, nil
+}
+
+// lastDeployed returns the last revision with status deployed from the
+// release history, 0 if there is none
+func (h *HelmCmd) lastDeployed(ctx context.Context) (int, error) {
+	args := append([]string{"history", h.Release}, h.connArgs()...)
+	args = append(args, "-o", "json")
+	out, err := h.query(ctx, args...)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get release history: %s", err)
+	}
+	history := []releaseRevision{}
+	err = json.Unmarshal(out, &history)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse release history: %s", err)
+	}
+	last := 0
+	for _, revision := range history {
+		if revision.Status == "deployed" && revision.Revision > last {
+			last = revision.Revision
+		}
+	}
+	return last, nil
+}
+
+// recover rolls back to the target revision or uninstalls the release after
+// err, the returned error reports the result of the recovery
+func (h *HelmCmd) recover(ctx context.Context, target *rollbackTarget, err error) error {
+	log.Printf("DEPLOYMENT FAILED: %s", err)
+	action, restoreErr := h.restore(ctx, target)
+	if restoreErr != nil {
+		log.Printf("%s FAILED: %s", action, restoreErr)
+		wrapped := Wrap(restoreErr, fmt.Sprintf("release and %s failed", action), core.RollbackFailedErrorKind)
+		h.fireRollback(ctx, restoreErr, wrapped)
+		return wrapped
+	}
+	log.Printf("%s SUCCESSFUL", action)
+	wrapped := Wrap(err, fmt.Sprintf("release failed and %s successful", action), core.RollbackSuccessErrorKind)
+	h.fireRollback(ctx, nil, wrapped)
+	return wrapped
+}
+
+// fireRollback fires the rollback hooks after every automatic rollback or
+// uninstall, whatever caused it, outcome is the error the hooks receive
+func (h *HelmCmd) fireRollback(ctx context.Context, rollbackErr error, outcome error) {
+	if rollbackErr != nil {
+		h.fire(ctx, h.OnRollbackFailed, outcome)
+	} else {
+		h.fire(ctx, h.OnRollbackSuccess, outcome)
+	}
+}
+
+// restore rolls back to the target revision or uninstalls the release if
+// there is none, it returns the action taken
+func (h *HelmCmd) restore(ctx context.Context, target *rollbackTarget) (string, error) {
+	if target.Revision > 0 {
+		log.Printf("rolling back %s to revision %d", h.Release, target.Revision)
+		return "rollback", h.run(ctx, Command{Phase: PhaseRollback, Args: append([]string{"helm"}, h.rollbackArgs(target.Revision)...)})
+	}
+	log.Printf("uninstalling %s", h.Release)
+	return "uninstall", h.run(ctx, Command{Phase: PhaseRollback, Args: append([]string{"helm"}, h.uninstallArgs()...)})
+}
+
+// rollbackArgs returns the arguments for `helm rollback` to revision, the
+// previous revision if 0
+func (h *HelmCmd) rollbackArgs(revision int) []string {
+	args := append([]string{"rollback"}, h.connArgs()...)
+	if h.Timeout > 0 {
+		args = append(args, "--timeout", h.Timeout.String())
+	}
+	if h.RollbackWait {
+		args = append(args, "--wait")
+	}
+	args = append(args, h.Release)
+	if revision > 0 {
+		args = append(args, strconv.Itoa(revision))
+	}
+	return args
+}
+
+// uninstallArgs returns the arguments for `helm uninstall` of the release
+func (h *HelmCmd) uninstallArgs() []string {
+	args := append([]string{"uninstall", h.Release}, h.connArgs()...)
+	if h.Timeout > 0 {
+		args = append(args, "--timeout", h.Timeout.String())
+	}
+	return args
+}
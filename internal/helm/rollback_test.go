@@ -0,0 +1,147 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+)
+
+func TestRollbackOnFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	expectList := func(list string) {
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "list", "--all", "--filter", "^foo$", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return([]byte(list), nil)
+	}
+	expectHistory := func() {
+		mockRunner.EXPECT().Output(
+			context.Background(),
+			"helm", "history", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "-o", "json",
+		).Return([]byte(`[
+			{"revision": 1, "status": "superseded"},
+			{"revision": 2, "status": "deployed"},
+			{"revision": 3, "status": "failed"}
+		]`), nil)
+	}
+	expectUpgrade := func(atomic bool, err error) {
+		args := []interface{}{"upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config"}
+		if atomic {
+			args = append(args, "--atomic")
+		}
+		args = append(args, "foo", "chart")
+		mockRunner.EXPECT().Run(context.Background(), "helm", args...).Return(err)
+	}
+
+	tests := []struct {
+		name   string
+		extra  []HelmOption
+		setup  func()
+		runErr error
+	}{
+		{
+			name: "successful deployment",
+			setup: func() {
+				expectList(`[{"revision": 3, "status": "failed"}]`)
+				expectHistory()
+				expectUpgrade(false, nil)
+			},
+		},
+		{
+			name: "failed post command rolls back to last deployed revision",
+			extra: []HelmOption{
+				WithPostCommand("false"),
+			},
+			setup: func() {
+				expectList(`[{"revision": 3, "status": "failed"}]`)
+				expectHistory()
+				expectUpgrade(false, nil)
+				mockRunner.EXPECT().Run(context.Background(), "false").Return(fmt.Errorf("exit 1"))
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "rollback", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "2",
+				)
+			},
+			runErr: fmt.Errorf("release failed and rollback successful: postcmd failed: exit 1"),
+		},
+		{
+			name: "failed first install is uninstalled",
+			extra: []HelmOption{
+				WithTimeout(time.Minute),
+			},
+			setup: func() {
+				expectList(`[]`)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "--timeout", "1m0s", "foo", "chart",
+				).Return(fmt.Errorf("runfail"))
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "uninstall", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config", "--timeout", "1m0s",
+				)
+			},
+			runErr: fmt.Errorf("release failed and uninstall successful: helm failed: runfail"),
+		},
+		{
+			name: "failed tests and failed rollback",
+			extra: []HelmOption{
+				WithTest(true, "foo"),
+				WithTestRollback(true, "foo"),
+			},
+			setup: func() {
+				expectList(`[{"revision": 3, "status": "failed"}]`)
+				expectHistory()
+				expectUpgrade(false, nil)
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "test", "--logs", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo",
+				).Return(fmt.Errorf("testfail"))
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "rollback", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "2",
+				).Return(fmt.Errorf("rollbackfail"))
+			},
+			runErr: fmt.Errorf("release and rollback failed: rollbackfail"),
+		},
+		{
+			name: "atomic upgrade is not rolled back twice",
+			extra: []HelmOption{
+				WithAtomic(true),
+			},
+			setup: func() {
+				expectList(`[{"revision": 3, "status": "failed"}]`)
+				expectHistory()
+				expectUpgrade(true, fmt.Errorf("runfail"))
+			},
+			runErr: fmt.Errorf("helm failed: runfail"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		options := append([]HelmOption{
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			WithRunner(mockRunner),
+			WithRollbackOnFailure(true),
+		}, test.extra...)
+		cmd, err := NewHelmCmd(WithInstallUpgradeMode(), options...)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		test.setup()
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+	}
+}
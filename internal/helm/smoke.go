@@ -0,0 +1,197 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// SmokeCheck is a HTTP request that has to succeed after the deployment
+	SmokeCheck struct {
+		URL       string `json:"url"`
+		Status    int    `json:"status"`
+		Contains  string `json:"contains"`
+		JSONPath  string `json:"json_path"`
+		JSONValue string `json:"json_value"`
+
+		// Interval and Deadline are durations like 5s, the request is
+		// retried every Interval until Deadline is exceeded
+		Interval string `json:"interval"`
+		Deadline string `json:"deadline"`
+
+		interval time.Duration
+		deadline time.Duration
+	}
+)
+
+const (
+	defaultSmokeInterval = 5 * time.Second
+	defaultSmokeDeadline = time.Minute
+)
+
+// ParseSmokeChecks parses a YAML/JSON list of smoke checks, items may be
+// plain URLs that are expected to return 200
+func ParseSmokeChecks(spec string) ([]SmokeCheck, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	items := []json.RawMessage{}
+	err := yaml.Unmarshal([]byte(spec), &items)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse smoke checks: %s", err)
+	}
+	checks := make([]SmokeCheck, 0, len(items))
+	for _, item := range items {
+		check := SmokeCheck{}
+		if json.Unmarshal(item, &check.URL) != nil {
+			err := json.Unmarshal(item, &check)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse smoke check: %s", err)
+			}
+		}
+		if check.URL == "" {
+			return nil, fmt.Errorf("smoke check requires url: %s", item)
+		}
+		if check.Status == 0 {
+			check.Status = http.StatusOK
+		}
+		check.interval, err = parseDuration(check.Interval, defaultSmokeInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval of smoke check %s: %s", check.URL, err)
+		}
+		check.deadline, err = parseDuration(check.Deadline, defaultSmokeDeadline)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deadline of smoke check %s: %s", check.URL, err)
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// WithSmokeChecks runs the checks after the deployment and tests, failed
+// checks roll back the release if rollback is set
+func WithSmokeChecks(checks []SmokeCheck, rollback bool) HelmOption {
+	return func(c *HelmCmd) error {
+		c.SmokeChecks = checks
+		c.SmokeRollback = rollback
+		return nil
+	}
+}
+
+// smoke runs all smoke checks, all checks are run even if one fails
+func (h *HelmCmd) smoke(ctx context.Context) error {
+	failed := []string{}
+	for _, check := range h.SmokeChecks {
+		err := check.run(ctx, http.DefaultClient)
+		if err != nil {
+			log.Printf("smoke check %s failed: %s", check.URL, err)
+			failed = append(failed, check.URL)
+			continue
+		}
+		log.Printf("smoke check %s successful", check.URL)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed smoke checks: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// run retries the check until it succeeds or the deadline is exceeded
+func (c *SmokeCheck) run(ctx context.Context, client *http.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, c.deadline)
+	defer cancel()
+	for {
+		err := c.probe(ctx, client)
+		if err == nil {
+			return nil
+		}
+		log.Printf("smoke check %s: %s, retrying in %s", c.URL, err, c.interval)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("deadline of %s exceeded: %s", c.deadline, err)
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// probe runs a single request of the check
+func (c *SmokeCheck) probe(ctx context.Context, client *http.Client) error {
+	req, err := http.NewRequest(http.MethodGet, c.URL, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %s", err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response: %s", err)
+	}
+	if resp.StatusCode != c.Status {
+		return fmt.Errorf("expected status %d, got %d", c.Status, resp.StatusCode)
+	}
+	if c.Contains != "" && !strings.Contains(string(body), c.Contains) {
+		return fmt.Errorf("response does not contain %q", c.Contains)
+	}
+	if c.JSONPath != "" {
+		var data interface{}
+		err := json.Unmarshal(body, &data)
+		if err != nil {
+			return fmt.Errorf("unable to parse response as json: %s", err)
+		}
+		value, err := lookupJSONPath(data, c.JSONPath)
+		if err != nil {
+			return err
+		}
+		if c.JSONValue != "" && fmt.Sprint(value) != c.JSONValue {
+			return fmt.Errorf("expected %s to be %q, got %q", c.JSONPath, c.JSONValue, fmt.Sprint(value))
+		}
+	}
+	return nil
+}
+
+// lookupJSONPath returns the value at a dotted path like .status.checks.0.ok
+func lookupJSONPath(data interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return data, nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch typed := data.(type) {
+		case map[string]interface{}:
+			value, ok := typed[key]
+			if !ok {
+				return nil, fmt.Errorf("json path %s not found", path)
+			}
+			data = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(typed) {
+				return nil, fmt.Errorf("json path %s not found", path)
+			}
+			data = typed[index]
+		default:
+			return nil, fmt.Errorf("json path %s not found", path)
+		}
+	}
+	return data, nil
+}
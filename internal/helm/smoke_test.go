@@ -0,0 +1,167 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSmokeChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   string
+		checks []SmokeCheck
+		err    error
+	}{
+		{
+			name: "empty",
+			spec: "",
+		},
+		{
+			name: "plain url and full check",
+			spec: `
+- https://example.com/health
+- url: https://example.com/status
+  status: 204
+  json_path: .status
+  json_value: ok
+  interval: 1s
+  deadline: 10s
+`,
+			checks: []SmokeCheck{
+				{URL: "https://example.com/health", Status: 200, interval: 5 * time.Second, deadline: time.Minute},
+				{
+					URL: "https://example.com/status", Status: 204, JSONPath: ".status", JSONValue: "ok",
+					Interval: "1s", Deadline: "10s", interval: time.Second, deadline: 10 * time.Second,
+				},
+			},
+		},
+		{
+			name: "missing url",
+			spec: `[{"status": 200}]`,
+			err:  fmt.Errorf(`smoke check requires url: {"status":200}`),
+		},
+		{
+			name: "invalid deadline",
+			spec: `[{"url": "https://example.com", "deadline": "soon"}]`,
+			err:  fmt.Errorf(`invalid deadline of smoke check https://example.com: time: invalid duration "soon"`),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		checks, err := ParseSmokeChecks(test.spec)
+		if !errEq(err, test.err) {
+			t.Fatalf("unable to parse smoke checks:\n- %v\n+ %v", test.err, err)
+		}
+		if diff := cmp.Diff(test.checks, checks, cmp.AllowUnexported(SmokeCheck{})); diff != "" {
+			t.Fatalf(diff)
+		}
+	}
+}
+
+func TestSmokeChecks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/ready":
+			// becomes ready on the second request
+			if requests < 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `{"status": {"checks": [{"ok": true}]}}`)
+		case "/version":
+			fmt.Fprint(w, "version 1.2.3")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	spec := func(path string, extra string) string {
+		return fmt.Sprintf(`[{"url": "%s%s", "interval": "10ms", "deadline": "200ms"%s}]`, server.URL, path, extra)
+	}
+	expectUpgrade := func() {
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+		)
+	}
+
+	tests := []struct {
+		name     string
+		spec     string
+		rollback bool
+		setup    func()
+		runErr   error
+	}{
+		{
+			name:  "retry until json path matches",
+			spec:  spec("/ready", `, "json_path": "status.checks.0.ok", "json_value": "true"`),
+			setup: expectUpgrade,
+		},
+		{
+			name:  "body contains",
+			spec:  spec("/version", `, "contains": "1.2.3"`),
+			setup: expectUpgrade,
+		},
+		{
+			name:   "wrong status",
+			spec:   spec("/missing", ""),
+			setup:  expectUpgrade,
+			runErr: fmt.Errorf("smoke checks failed: failed smoke checks: %s/missing", server.URL),
+		},
+		{
+			name:     "wrong body with rollback",
+			spec:     spec("/version", `, "contains": "2.0.0"`),
+			rollback: true,
+			setup: func() {
+				expectUpgrade()
+				mockRunner.EXPECT().Run(
+					context.Background(),
+					"helm", "rollback", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo",
+				)
+			},
+			runErr: fmt.Errorf("release failed and rollback successful: failed smoke checks: %s/version", server.URL),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		requests = 0
+		checks, err := ParseSmokeChecks(test.spec)
+		if err != nil {
+			t.Fatalf("unable to parse smoke checks: %s", err)
+		}
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			WithSmokeChecks(checks, test.rollback),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		test.setup()
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+	}
+}
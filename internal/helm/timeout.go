@@ -0,0 +1,172 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// PhaseTimeoutError is returned if a phase exceeded its timeout
+	PhaseTimeoutError struct {
+		Phase   Phase
+		Timeout time.Duration
+		Err     error
+	}
+)
+
+const (
+	// upgradeGrace is added to the upgrade phase timeout, helm applies its
+	// --timeout to the hooks and the wait separately and has to time out
+	// itself to leave the release in a consistent state
+	upgradeGrace = 5 * time.Minute
+
+	// runMargin is added to the timeout of a run for the phases without a
+	// timeout
+	runMargin = 10 * time.Minute
+)
+
+// timeoutPhases are the phases that can have a timeout
+var timeoutPhases = []Phase{
+	PhaseRegistryLogin,
+	PhaseRepoAdd,
+	PhaseRepoUpdate,
+	PhaseDependencyBuild,
+	PhaseDependencyUpdate,
+	PhaseLint,
+	PhasePreCommand,
+	PhaseRender,
+	PhaseUpgrade,
+	PhaseVerify,
+	PhaseTest,
+	PhaseRollback,
+	PhasePostCommand,
+	PhasePush,
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	return fmt.Sprintf("phase %s timed out after %s: %s", e.Phase, e.Timeout, e.Err)
+}
+
+// ParsePhaseTimeouts parses the timeouts per phase, either a YAML/JSON
+// object or comma separated phase=duration pairs
+func ParsePhaseTimeouts(spec string) (map[Phase]time.Duration, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	raw := map[string]string{}
+	if strings.HasPrefix(spec, "{") || strings.Contains(spec, ":") {
+		err := yaml.Unmarshal([]byte(spec), &raw)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse phase timeouts: %s", err)
+		}
+	} else {
+		for _, pair := range strings.Split(spec, ",") {
+			split := strings.SplitN(pair, "=", 2)
+			if len(split) != 2 {
+				return nil, fmt.Errorf("not in phase=duration format: %s", pair)
+			}
+			raw[strings.TrimSpace(split[0])] = strings.TrimSpace(split[1])
+		}
+	}
+
+	timeouts := map[Phase]time.Duration{}
+	for phase, value := range raw {
+		if !knownPhase(phase) {
+			return nil, fmt.Errorf("unknown phase %q, allowed are %s", phase, strings.Join(timeoutPhases, ", "))
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout of phase %s: %s", phase, err)
+		}
+		timeouts[phase] = timeout
+	}
+	return timeouts, nil
+}
+
+func knownPhase(phase Phase) bool {
+	for _, known := range timeoutPhases {
+		if phase == known {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPhaseTimeouts limits the duration of the commands of each phase
+func WithPhaseTimeouts(timeouts map[Phase]time.Duration) HelmOption {
+	return func(c *HelmCmd) error {
+		for phase := range timeouts {
+			if !knownPhase(phase) {
+				return fmt.Errorf("unknown phase %q", phase)
+			}
+		}
+		c.PhaseTimeouts = timeouts
+		return nil
+	}
+}
+
+// RunTimeout returns the limit of a whole run, the helm timeout or the
+// upgrade phase timeout replacing it, the other phase timeouts and a margin
+func RunTimeout(timeout time.Duration, timeouts map[Phase]time.Duration) time.Duration {
+	if upgrade := timeouts[PhaseUpgrade]; upgrade > 0 {
+		timeout = upgrade
+	}
+	total := timeout + upgradeGrace + runMargin
+	for phase, t := range timeouts {
+		if phase != PhaseUpgrade && t > 0 {
+			total += t
+		}
+	}
+	return total
+}
+
+// upgradeTimeout passes the upgrade phase timeout to helm as --timeout, so
+// helm stops the upgrade itself instead of being interrupted
+func (h *HelmCmd) upgradeTimeout() {
+	timeout := h.PhaseTimeouts[PhaseUpgrade]
+	if timeout <= 0 || h.Mode != InstallUpgradeMode {
+		return
+	}
+	h.Timeout = timeout
+	for i := 0; i < len(h.Args)-1; i++ {
+		if h.Args[i] == "--timeout" {
+			h.Args[i+1] = timeout.String()
+			return
+		}
+	}
+	h.Args = append(h.Args, "--timeout", timeout.String())
+}
+
+// phaseContext returns the context for a command of the phase, limited by
+// the timeout of the phase if there is one
+func (h *HelmCmd) phaseContext(ctx context.Context, phase Phase) (context.Context, context.CancelFunc) {
+	timeout, ok := h.PhaseTimeouts[phase]
+	if !ok || timeout <= 0 {
+		return ctx, func() {}
+	}
+	if phase == PhaseUpgrade {
+		// only stops a helm that does not return after its own timeout
+		timeout += upgradeGrace
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// phaseError names the phase in err if the phase timed out, a timeout of
+// the parent context is not attributed to the phase
+func (h *HelmCmd) phaseError(parent, ctx context.Context, phase Phase, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*PhaseTimeoutError); ok {
+		return err
+	}
+	if ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+		return &PhaseTimeoutError{Phase: phase, Timeout: h.PhaseTimeouts[phase], Err: err}
+	}
+	return err
+}
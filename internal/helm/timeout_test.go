@@ -0,0 +1,208 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePhaseTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		timeouts map[Phase]time.Duration
+		err      error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "pairs",
+			spec:     "repo-update=2m, upgrade=20m",
+			timeouts: map[Phase]time.Duration{PhaseRepoUpdate: 2 * time.Minute, PhaseUpgrade: 20 * time.Minute},
+		},
+		{
+			name:     "json",
+			spec:     `{"test": "5m", "rollback": "10m"}`,
+			timeouts: map[Phase]time.Duration{PhaseTest: 5 * time.Minute, PhaseRollback: 10 * time.Minute},
+		},
+		{
+			name:     "yaml",
+			spec:     "lint: 30s\npre-command: 1m\n",
+			timeouts: map[Phase]time.Duration{PhaseLint: 30 * time.Second, PhasePreCommand: time.Minute},
+		},
+		{
+			name: "unknown phase",
+			spec: "deploy=1m",
+			err:  fmt.Errorf(`unknown phase "deploy", allowed are registry-login, repo-add, repo-update, dependency-build, dependency-update, lint, pre-command, render, upgrade, verify, test, rollback, post-command, push`),
+		},
+		{
+			name: "invalid duration",
+			spec: "upgrade=soon",
+			err:  fmt.Errorf(`invalid timeout of phase upgrade: time: invalid duration "soon"`),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		timeouts, err := ParsePhaseTimeouts(test.spec)
+		if !errEq(err, test.err) {
+			t.Fatalf("unable to parse phase timeouts:\n- %v\n+ %v", test.err, err)
+		}
+		if diff := cmp.Diff(test.timeouts, timeouts); diff != "" {
+			t.Fatalf(diff)
+		}
+	}
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	hang := func(ctx context.Context, _ string, _ ...string) error {
+		<-ctx.Done()
+		return fmt.Errorf("signal: terminated")
+	}
+
+	tests := []struct {
+		name   string
+		setup  func()
+		runErr error
+		phase  Phase
+	}{
+		{
+			name: "repo update times out",
+			setup: func() {
+				mockRunner.EXPECT().RunWithStdin(gomock.Any(), gomock.Any(), "helm", "repo", "add", "stable", "https://charts.example.com", "--username", "user", "--password-stdin")
+				mockRunner.EXPECT().Run(gomock.Any(), "helm", "repo", "update").DoAndReturn(hang)
+			},
+			runErr: fmt.Errorf("precmd failed: phase repo-update timed out after 10ms: signal: terminated"),
+			phase:  PhaseRepoUpdate,
+		},
+		{
+			name: "test times out",
+			setup: func() {
+				mockRunner.EXPECT().RunWithStdin(gomock.Any(), gomock.Any(), "helm", "repo", "add", "stable", "https://charts.example.com", "--username", "user", "--password-stdin")
+				mockRunner.EXPECT().Run(gomock.Any(), "helm", "repo", "update")
+				mockRunner.EXPECT().Run(gomock.Any(), "helm", "upgrade", "--install", "-n", "foo", "foo", "chart")
+				mockRunner.EXPECT().Run(gomock.Any(), "helm", "test", "--logs", "-n", "foo", "foo").DoAndReturn(hang)
+			},
+			runErr: fmt.Errorf("release tests failed: phase test timed out after 10ms: signal: terminated"),
+			phase:  PhaseTest,
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithChart("chart"),
+			WithHelmRepos([]HelmRepo{{Name: "stable", URL: "https://charts.example.com", Username: "user", Password: "pass"}}),
+			WithTest(true, "foo"),
+			WithPhaseTimeouts(map[Phase]time.Duration{
+				PhaseRepoUpdate: 10 * time.Millisecond,
+				PhaseTest:       10 * time.Millisecond,
+			}),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		test.setup()
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+		if phase := err.(*HelmError).Phase; phase != test.phase {
+			t.Fatalf("unexpected phase %q", phase)
+		}
+	}
+}
+
+func TestUpgradeTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	tests := []struct {
+		name    string
+		options []HelmOption
+		upgrade time.Duration
+		timeout time.Duration
+		args    []string
+	}{
+		{
+			name:    "replaces the helm timeout",
+			options: []HelmOption{WithTimeout(15 * time.Minute)},
+			upgrade: 20 * time.Minute,
+			timeout: 20 * time.Minute,
+			args:    []string{"upgrade", "--install", "--timeout", "20m0s", "foo", "chart"},
+		},
+		{
+			name:    "sets the helm timeout",
+			upgrade: 20 * time.Minute,
+			timeout: 20 * time.Minute,
+			args:    []string{"upgrade", "--install", "--timeout", "20m0s", "foo", "chart"},
+		},
+		{
+			name:    "without upgrade phase timeout",
+			options: []HelmOption{WithTimeout(15 * time.Minute)},
+			timeout: 15 * time.Minute,
+			args:    []string{"upgrade", "--install", "--timeout", "15m0s", "foo", "chart"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		timeouts := map[Phase]time.Duration{PhaseTest: time.Minute}
+		if test.upgrade != 0 {
+			timeouts[PhaseUpgrade] = test.upgrade
+		}
+		options := append([]HelmOption{
+			WithRelease("foo"),
+			WithChart("chart"),
+			WithRunner(mockRunner),
+		}, test.options...)
+		cmd, err := NewHelmCmd(WithInstallUpgradeMode(), append(options, WithPhaseTimeouts(timeouts))...)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		if cmd.Timeout != test.timeout {
+			t.Fatalf("unexpected timeout %s", cmd.Timeout)
+		}
+		if diff := cmp.Diff(test.args, cmd.Args); diff != "" {
+			t.Fatalf(diff)
+		}
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	tests := []struct {
+		timeouts map[Phase]time.Duration
+		want     time.Duration
+	}{
+		{want: 30 * time.Minute},
+		{
+			timeouts: map[Phase]time.Duration{PhaseUpgrade: 40 * time.Minute},
+			want:     55 * time.Minute,
+		},
+		{
+			timeouts: map[Phase]time.Duration{PhaseUpgrade: 5 * time.Minute, PhaseTest: 10 * time.Minute, PhasePreCommand: 20 * time.Minute},
+			want:     50 * time.Minute,
+		},
+	}
+	for i, test := range tests {
+		got := RunTimeout(15*time.Minute, test.timeouts)
+		if got != test.want {
+			t.Fatalf("#%d: unexpected run timeout:\n- %s\n+ %s", i, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type (
+	// workloadState is the result of the verification of a workload
+	workloadState struct {
+		Resource manifestResource
+		State    string
+		Err      error
+	}
+)
+
+// PhaseVerify checks the rollout of the workloads after the upgrade
+const PhaseVerify Phase = "verify"
+
+// WithVerify checks the rollout of the workloads of the release after the
+// upgrade, each workload has to become healthy within timeout
+func WithVerify(verify bool, timeout time.Duration) HelmOption {
+	return func(c *HelmCmd) error {
+		c.Verify = verify
+		c.VerifyTimeout = timeout
+		return nil
+	}
+}
+
+// verify checks the Deployments, StatefulSets, DaemonSets and Jobs of the
+// release manifest and logs their states
+func (h *HelmCmd) verify(ctx context.Context) error {
+	resources, err := h.manifest(ctx)
+	if err != nil {
+		return err
+	}
+	states := []workloadState{}
+	failed := []string{}
+	err = h.run(ctx, Command{Phase: PhaseVerify, Args: []string{"kubectl", "rollout", "status"}, Func: func(ctx context.Context) error {
+		for _, resource := range resources {
+			if resource.Namespace == "" {
+				resource.Namespace = h.Namespace
+			}
+			args := h.verifyArgs(resource)
+			if args == nil {
+				continue
+			}
+			state := workloadState{Resource: resource, State: "ready"}
+			if resource.Kind == "Job" {
+				state.State = "complete"
+			}
+			state.Err = h.retry(ctx, PhaseVerify, func() error {
+				return h.Runner.Run(ctx, "kubectl", args...)
+			})
+			if state.Err != nil {
+				state.State = "unhealthy"
+				failed = append(failed, fmt.Sprintf("%s/%s", strings.ToLower(resource.Kind), resource.Name))
+			}
+			states = append(states, state)
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("unhealthy workloads: %s", strings.Join(failed, ", "))
+		}
+		return nil
+	}})
+	logWorkloadStates(states)
+	return err
+}
+
+// verifyArgs returns the kubectl arguments to check the resource, nil if
+// the resource is not a workload
+func (h *HelmCmd) verifyArgs(resource manifestResource) []string {
+	ref := fmt.Sprintf("%s/%s", strings.ToLower(resource.Kind), resource.Name)
+	var args []string
+	switch resource.Kind {
+	case "Deployment", "StatefulSet", "DaemonSet":
+		args = []string{"rollout", "status", ref}
+	case "Job":
+		args = []string{"wait", "--for=condition=complete", ref}
+	default:
+		return nil
+	}
+	if h.VerifyTimeout > 0 {
+		args = append(args, "--timeout", h.VerifyTimeout.String())
+	}
+	return append(args, h.kubeArgs(resource.Namespace)...)
+}
+
+// logWorkloadStates logs the states as table
+func logWorkloadStates(states []workloadState) {
+	if len(states) == 0 {
+		log.Printf("no workloads to verify")
+		return
+	}
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME\tSTATE")
+	for _, state := range states {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", state.Resource.Kind, state.Resource.Namespace, state.Resource.Name, state.State)
+	}
+	_ = w.Flush()
+	log.Printf("workload states:\n%s", buf)
+}
@@ -0,0 +1,91 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+)
+
+const verifyManifest = `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+---
+# Source: app/templates/job.yaml
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  namespace: other
+`
+
+func TestVerify(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	tests := []struct {
+		name   string
+		jobErr error
+		runErr error
+	}{
+		{
+			name: "healthy workloads",
+		},
+		{
+			name:   "failed job",
+			jobErr: fmt.Errorf("timed out"),
+			runErr: fmt.Errorf("rollout verification failed: unhealthy workloads: job/migrate"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		cmd, err := NewHelmCmd(
+			WithInstallUpgradeMode(),
+			WithRelease("foo"),
+			WithNamespace("foo"),
+			WithKubeConfig("/root/.kube/config"),
+			WithChart("chart"),
+			WithVerify(true, 2*time.Minute),
+			WithRunner(mockRunner),
+		)
+		if err != nil {
+			t.Fatalf("unable to create helm cmd: %s", err)
+		}
+		gomock.InOrder(
+			mockRunner.EXPECT().Run(
+				context.Background(),
+				"helm", "upgrade", "--install", "-n", "foo", "--kubeconfig", "/root/.kube/config", "foo", "chart",
+			),
+			mockRunner.EXPECT().Output(
+				context.Background(),
+				"helm", "get", "manifest", "foo", "-n", "foo", "--kubeconfig", "/root/.kube/config",
+			).Return([]byte(verifyManifest), nil),
+			mockRunner.EXPECT().Run(
+				context.Background(),
+				"kubectl", "rollout", "status", "deployment/app", "--timeout", "2m0s", "-n", "foo", "--kubeconfig", "/root/.kube/config",
+			),
+			mockRunner.EXPECT().Run(
+				context.Background(),
+				"kubectl", "wait", "--for=condition=complete", "job/migrate", "--timeout", "2m0s", "-n", "other", "--kubeconfig", "/root/.kube/config",
+			).Return(test.jobErr),
+		)
+		err = cmd.Run(context.Background())
+		if !errEq(err, test.runErr) {
+			t.Fatalf("unable to run helm cmd:\n- %v\n+ %v", test.runErr, err)
+		}
+	}
+}
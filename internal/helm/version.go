@@ -0,0 +1,162 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// repoIndex is the subset of a helm repository index.yaml required to
+	// resolve chart versions
+	repoIndex struct {
+		Entries map[string][]struct {
+			Version string `json:"version"`
+		} `json:"entries"`
+	}
+)
+
+// RepositoryCache returns the directory helm stores repository indexes in
+func RepositoryCache() string {
+	if dir := os.Getenv("HELM_REPOSITORY_CACHE"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("HELM_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "repository")
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "helm", "repository")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".cache", "helm", "repository")
+}
+
+// RepositoryConfig returns the repositories.yaml helm reads the repositories
+// from
+func RepositoryConfig() string {
+	if file := os.Getenv("HELM_REPOSITORY_CONFIG"); file != "" {
+		return file
+	}
+	if dir := os.Getenv("HELM_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "repositories.yaml")
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "helm", "repositories.yaml")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "helm", "repositories.yaml")
+}
+
+// IsRepoChart reports if the chart is a `repo/name` reference to one of the
+// repos, a local chart may not exist yet so the filesystem is not consulted
+func IsRepoChart(chart string, repos []string) bool {
+	if IsOCI(chart) {
+		return false
+	}
+	split := strings.Split(chart, "/")
+	if len(split) != 2 {
+		return false
+	}
+	for _, repo := range repos {
+		if split[0] == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// repoChart reports if the chart references one of the HELM_REPOS or a
+// repository added otherwise, e.g. by the pre commands, it has to be called
+// after the pre commands ran
+func (h *HelmCmd) repoChart(ctx context.Context) (bool, error) {
+	names := []string{}
+	for _, repo := range h.Repos {
+		names = append(names, repo.Name)
+	}
+	if IsRepoChart(h.Chart, names) {
+		return true, nil
+	}
+	if IsOCI(h.Chart) || len(strings.Split(h.Chart, "/")) != 2 {
+		return false, nil
+	}
+	out, err := h.query(ctx, "repo", "list", "-o", "json")
+	if err != nil && strings.Contains(commandOutput(err), "no repositories") {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to list repositories: %s", err)
+	}
+	repos := []struct {
+		Name string `json:"name"`
+	}{}
+	err = json.Unmarshal(out, &repos)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse repository list: %s", err)
+	}
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+	return IsRepoChart(h.Chart, names), nil
+}
+
+// ResolveChartVersion returns the highest version of a `repo/name` chart in
+// the downloaded repository index that satisfies the constraint
+func ResolveChartVersion(chart, constraint string, devel bool) (string, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return "", fmt.Errorf("invalid chart version %q: %s", constraint, err)
+	}
+	split := strings.SplitN(chart, "/", 2)
+	repo, name := split[0], split[1]
+
+	file := filepath.Join(RepositoryCache(), fmt.Sprintf("%s-index.yaml", repo))
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read index of repo %q: %s", repo, err)
+	}
+	index := &repoIndex{}
+	err = yaml.Unmarshal(data, index)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse index of repo %q: %s", repo, err)
+	}
+
+	var best *semver.Version
+	for _, entry := range index.Entries[name] {
+		v, err := semver.NewVersion(entry.Version)
+		if err != nil {
+			continue
+		}
+		if !satisfies(c, v, devel) {
+			continue
+		}
+		if best == nil || v.GreaterThan(best) {
+			best = v
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no version of chart %q matches %q", chart, constraint)
+	}
+	return best.Original(), nil
+}
+
+// satisfies checks the constraint, with devel pre-releases are checked as if
+// they were the release they precede
+func satisfies(c *semver.Constraints, v *semver.Version, devel bool) bool {
+	if c.Check(v) {
+		return true
+	}
+	if !devel || v.Prerelease() == "" {
+		return false
+	}
+	release, err := v.SetPrerelease("")
+	if err != nil {
+		return false
+	}
+	return c.Check(&release)
+}
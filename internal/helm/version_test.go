@@ -0,0 +1,187 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitsbeats/drone-helm3/mock"
+	"github.com/golang/mock/gomock"
+)
+
+const testIndex = `
+apiVersion: v1
+entries:
+  redis:
+    - version: 17.2.0
+    - version: 17.3.1
+    - version: 17.3.8
+    - version: 17.4.0-rc.1
+    - version: 18.0.0
+`
+
+func TestResolveChartVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-helm3")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "bitnami-index.yaml"), []byte(testIndex), 0600)
+	if err != nil {
+		t.Fatalf("unable to write index: %s", err)
+	}
+	os.Setenv("HELM_REPOSITORY_CACHE", dir)
+	defer os.Unsetenv("HELM_REPOSITORY_CACHE")
+
+	tests := []struct {
+		chart      string
+		constraint string
+		devel      bool
+		want       string
+		err        error
+	}{
+		{chart: "bitnami/redis", constraint: "17.3.1", want: "17.3.1"},
+		{chart: "bitnami/redis", constraint: "~17.3", want: "17.3.8"},
+		{chart: "bitnami/redis", constraint: ">=17.2 <18", want: "17.3.8"},
+		{chart: "bitnami/redis", constraint: ">=17.2 <18", devel: true, want: "17.4.0-rc.1"},
+		{chart: "bitnami/redis", constraint: "*", want: "18.0.0"},
+		{
+			chart: "bitnami/redis", constraint: "~19",
+			err: fmt.Errorf(`no version of chart "bitnami/redis" matches "~19"`),
+		},
+		{
+			chart: "bitnami/redis", constraint: "foo",
+			err: fmt.Errorf(`invalid chart version "foo": improper constraint: foo`),
+		},
+		{
+			chart: "missing/redis", constraint: "*",
+			err: fmt.Errorf(`unable to read index of repo "missing": open %s/missing-index.yaml: no such file or directory`, dir),
+		},
+	}
+	for i, test := range tests {
+		t.Logf("running #%d: %s %s", i, test.chart, test.constraint)
+		got, err := ResolveChartVersion(test.chart, test.constraint, test.devel)
+		if !errEq(err, test.err) {
+			t.Fatalf("unable to resolve version:\n- %v\n+ %v", test.err, err)
+		} else if err != nil {
+			continue
+		}
+		if got != test.want {
+			t.Fatalf("unexpected version:\n- %s\n+ %s", test.want, got)
+		}
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+	cmd, err := NewHelmCmd(
+		WithInstallUpgradeMode(),
+		WithRelease("redis"),
+		WithChart("bitnami/redis"),
+		WithChartVersion("~17.3", false),
+		WithNamespace("redis"),
+		WithRunner(mockRunner),
+	)
+	if err != nil {
+		t.Fatalf("unable to create helm cmd: %s", err)
+	}
+	gomock.InOrder(
+		mockRunner.EXPECT().Output(
+			context.Background(), "helm", "repo", "list", "-o", "json",
+		).Return([]byte(`[{"name": "bitnami", "url": "https://charts.bitnami.com/bitnami"}]`), nil),
+		mockRunner.EXPECT().Run(
+			context.Background(),
+			"helm", "upgrade", "--install", "-n", "redis", "--version", "17.3.8", "redis", "bitnami/redis",
+		),
+	)
+	err = cmd.Run(context.Background())
+	if err != nil {
+		t.Fatalf("unable to run helm cmd: %s", err)
+	}
+	if cmd.ChartVersion != "17.3.8" {
+		t.Fatalf("resolved version not stored: %s", cmd.ChartVersion)
+	}
+}
+
+func TestRepoChart(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRunner := mock.NewMockRunner(ctrl)
+
+	expectList := func(out string, err error) {
+		mockRunner.EXPECT().Output(context.Background(), "helm", "repo", "list", "-o", "json").Return([]byte(out), err)
+	}
+
+	tests := []struct {
+		name  string
+		chart string
+		repos []HelmRepo
+		setup func()
+		want  bool
+		err   error
+	}{
+		{
+			name:  "helm repos",
+			chart: "bitnami/redis",
+			repos: []HelmRepo{{Name: "bitnami", URL: "https://charts.bitnami.com/bitnami"}},
+			setup: func() {},
+			want:  true,
+		},
+		{
+			name:  "added by pre commands",
+			chart: "bitnami/redis",
+			setup: func() {
+				expectList(`[{"name": "bitnami", "url": "https://charts.bitnami.com/bitnami"}]`, nil)
+			},
+			want: true,
+		},
+		{
+			name:  "local chart",
+			chart: "charts/app",
+			setup: func() {
+				expectList(`[{"name": "bitnami", "url": "https://charts.bitnami.com/bitnami"}]`, nil)
+			},
+		},
+		{
+			name:  "no repositories",
+			chart: "charts/app",
+			setup: func() {
+				expectList("", &CommandError{Err: fmt.Errorf("exit status 1"), Stderr: "Error: no repositories to show"})
+			},
+		},
+		{
+			name:  "nested local chart",
+			chart: "./deploy/charts/app",
+			setup: func() {},
+		},
+		{
+			name:  "oci chart",
+			chart: "oci://registry.example.com/charts/app",
+			setup: func() {},
+		},
+		{
+			name:  "list failed",
+			chart: "bitnami/redis",
+			setup: func() {
+				expectList("", fmt.Errorf("exit status 1"))
+			},
+			err: fmt.Errorf("unable to list repositories: exit status 1"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		cmd := &HelmCmd{Chart: test.chart, Repos: test.repos, Runner: mockRunner}
+		test.setup()
+		got, err := cmd.repoChart(context.Background())
+		if !errEq(err, test.err) {
+			t.Fatalf("unable to classify chart:\n- %v\n+ %v", test.err, err)
+		}
+		if got != test.want {
+			t.Fatalf("unexpected classification of %s: %t", test.chart, got)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// Policy maps repositories to the deployments they are allowed to do
+	Policy struct {
+		Rules []Rule `json:"rules"`
+	}
+
+	// Rule allows the repositories matching one of the Repos patterns to
+	// deploy, empty lists allow everything
+	Rule struct {
+		Repos      []string `json:"repos"`
+		Namespaces []string `json:"namespaces"`
+		Releases   []string `json:"releases"`
+		Charts     []string `json:"charts"`
+		Events     []string `json:"events"`
+	}
+
+	// Request describes a deployment checked against the policy, ChartRepos
+	// maps the repository names of `repo/name` charts to their urls
+	Request struct {
+		Repo       string
+		Namespace  string
+		Release    string
+		Chart      string
+		ChartRepos map[string]string
+		Event      string
+	}
+)
+
+// DefaultFile is always enforced if it exists, it is meant to be mounted
+// into the plugin image where pipelines cannot change it
+const DefaultFile = "/etc/drone-helm3/policy.yaml"
+
+// Load reads the policy from a YAML or JSON file
+func Load(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy: %s", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses a YAML or JSON policy, unknown fields are rejected so typos
+// do not widen the policy
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	err := yaml.UnmarshalStrict(data, p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse policy: %s", err)
+	}
+	for i, rule := range p.Rules {
+		if len(rule.Repos) == 0 {
+			return nil, fmt.Errorf("rule #%d has no repos", i+1)
+		}
+		for _, patterns := range [][]string{rule.Repos, rule.Namespaces, rule.Releases, rule.Charts, rule.Events} {
+			for _, pattern := range patterns {
+				if strings.TrimSpace(pattern) == "" {
+					return nil, fmt.Errorf("rule #%d has an empty pattern", i+1)
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// Check returns an error naming the denied fields if no rule for the
+// repository allows the deployment
+func (p *Policy) Check(req Request) error {
+	reasons := []string{}
+	for i, rule := range p.Rules {
+		if !matchAny(rule.Repos, req.Repo) {
+			continue
+		}
+		denied := rule.denied(req)
+		if len(denied) == 0 {
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("rule #%d: %s", i+1, strings.Join(denied, ", ")))
+	}
+	if len(reasons) == 0 {
+		return fmt.Errorf("repository %s is not allowed to deploy, no policy rule matches", req.Repo)
+	}
+	return fmt.Errorf(
+		"repository %s is not allowed to deploy release %s to namespace %s on event %s (%s)",
+		req.Repo, req.Release, req.Namespace, req.Event, strings.Join(reasons, "; "),
+	)
+}
+
+// denied returns the fields of req not allowed by the rule
+func (r *Rule) denied(req Request) []string {
+	fields := []struct {
+		name     string
+		patterns []string
+		value    string
+	}{
+		{"namespace", r.Namespaces, req.Namespace},
+		{"release", r.Releases, req.Release},
+		{"chart", r.Charts, req.chart()},
+		{"event", r.Events, req.Event},
+	}
+	denied := []string{}
+	for _, field := range fields {
+		if field.name == "chart" && field.value == "" {
+			continue
+		}
+		if len(field.patterns) > 0 && !matchAny(field.patterns, field.value) {
+			denied = append(denied, fmt.Sprintf("%s %q not in %v", field.name, field.value, field.patterns))
+		}
+	}
+	return denied
+}
+
+// chart returns the chart source the patterns are matched against, the name
+// of a `repo/name` chart is chosen by the pipeline so it is replaced by the
+// url of the repository without credentials
+func (req Request) chart() string {
+	split := strings.Split(req.Chart, "/")
+	if len(split) != 2 {
+		return req.Chart
+	}
+	repo, ok := req.ChartRepos[split[0]]
+	if !ok {
+		return req.Chart
+	}
+	if u, err := url.Parse(repo); err == nil {
+		u.User = nil
+		repo = u.String()
+	}
+	return strings.TrimSuffix(repo, "/") + "/" + split[1]
+}
+
+// matchAny reports if value matches one of the glob patterns, `*` matches
+// any characters including `/`
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		expr := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+		if regexp.MustCompile(expr).MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// minLength is the minimum length of a secret, shorter values would
+// redact random parts of the output
+const minLength = 4
+
+// Writer replaces secrets in the written data with *** before passing it to
+// the underlying writer, the data is buffered per line
+type Writer struct {
+	w        io.Writer
+	replacer *strings.Replacer
+	buf      []byte
+	mu       sync.Mutex
+}
+
+func NewWriter(w io.Writer, secrets ...string) *Writer {
+	pairs := []string{}
+	for _, secret := range secrets {
+		if len(secret) < minLength {
+			continue
+		}
+		pairs = append(pairs, secret, "***")
+	}
+	return &Writer{
+		w:        w,
+		replacer: strings.NewReplacer(pairs...),
+	}
+}
+
+// String redacts the secrets in s
+func (r *Writer) String(s string) string {
+	return r.replacer.Replace(s)
+}
+
+func (r *Writer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	i := bytes.LastIndexByte(r.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	_, err := io.WriteString(r.w, r.replacer.Replace(string(r.buf[:i+1])))
+	r.buf = r.buf[i+1:]
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes incomplete lines
+func (r *Writer) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, r.replacer.Replace(string(r.buf)))
+	r.buf = r.buf[:0]
+	return err
+}
+
+// URL masks the credentials of a URL, strings without a scheme are returned
+// unchanged and unparsable URLs are masked completely
+func URL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "***"
+	}
+	if u.User == nil {
+		return s
+	}
+	u.User = nil
+	return strings.Replace(u.String(), "://", "://***@", 1)
+}
+
+// Args masks the values of --set and --set-string and the credentials of
+// URL arguments before a command line is logged
+func Args(args []string) []string {
+	masked := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && (args[i-1] == "--set-string" || args[i-1] == "--set") {
+			kv := strings.SplitN(arg, "=", 2)
+			masked[i] = fmt.Sprintf("%s=***", kv[0])
+			continue
+		}
+		masked[i] = URL(arg)
+	}
+	return masked
+}
@@ -0,0 +1,71 @@
+package values
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BuildMetadata describes the drone build that deploys a release
+type BuildMetadata struct {
+	Repo        string
+	Commit      string
+	Branch      string
+	Tag         string
+	BuildNumber string
+	BuildLink   string
+	Author      string
+}
+
+// Values returns the metadata as key=value pairs below key, suitable for
+// --set-string
+func (m *BuildMetadata) Values(key string) []string {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"repo", m.Repo},
+		{"commit", m.Commit},
+		{"branch", m.Branch},
+		{"tag", m.Tag},
+		{"build_number", m.BuildNumber},
+		{"build_link", m.BuildLink},
+		{"author", m.Author},
+	}
+	values := make([]string, 0, len(fields))
+	for _, field := range fields {
+		values = append(values, fmt.Sprintf("%s.%s=%s", key, field.name, escapeSetValue(field.value)))
+	}
+	return values
+}
+
+// Description returns a short summary used as helm release description
+func (m *BuildMetadata) Description() string {
+	parts := []string{}
+	if m.Repo != "" {
+		parts = append(parts, m.Repo)
+	}
+	if m.Commit != "" {
+		parts = append(parts, fmt.Sprintf("commit=%s", m.Commit))
+	}
+	if m.Branch != "" {
+		parts = append(parts, fmt.Sprintf("branch=%s", m.Branch))
+	}
+	if m.Tag != "" {
+		parts = append(parts, fmt.Sprintf("tag=%s", m.Tag))
+	}
+	if m.BuildNumber != "" {
+		parts = append(parts, fmt.Sprintf("build=%s", m.BuildNumber))
+	}
+	if m.Author != "" {
+		parts = append(parts, fmt.Sprintf("author=%s", m.Author))
+	}
+	if m.BuildLink != "" {
+		parts = append(parts, m.BuildLink)
+	}
+	return strings.Join(parts, " ")
+}
+
+// escapeSetValue escapes characters helm interprets in --set values
+func escapeSetValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `,`, `\,`).Replace(value)
+}
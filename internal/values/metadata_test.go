@@ -0,0 +1,37 @@
+package values
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildMetadata(t *testing.T) {
+	m := &BuildMetadata{
+		Repo:        "bitsbeats/myapp",
+		Commit:      "21ffea3",
+		Branch:      "main",
+		Tag:         "v1.2.3",
+		BuildNumber: "42",
+		BuildLink:   "https://drone.example.com/bitsbeats/myapp/42",
+		Author:      "Jane, Doe",
+	}
+
+	wantValues := []string{
+		"deployment.drone.repo=bitsbeats/myapp",
+		"deployment.drone.commit=21ffea3",
+		"deployment.drone.branch=main",
+		"deployment.drone.tag=v1.2.3",
+		"deployment.drone.build_number=42",
+		"deployment.drone.build_link=https://drone.example.com/bitsbeats/myapp/42",
+		`deployment.drone.author=Jane\, Doe`,
+	}
+	if diff := cmp.Diff(wantValues, m.Values("deployment.drone")); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	wantDescription := "bitsbeats/myapp commit=21ffea3 branch=main tag=v1.2.3 build=42 author=Jane, Doe https://drone.example.com/bitsbeats/myapp/42"
+	if diff := cmp.Diff(wantDescription, m.Description()); diff != "" {
+		t.Fatalf(diff)
+	}
+}
@@ -0,0 +1,239 @@
+package values
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// Chart holds the default values and the schema of a local chart
+	Chart struct {
+		Values map[string]interface{}
+		Schema []byte
+	}
+
+	// SchemaError lists all violations of the schema
+	SchemaError struct {
+		Violations []string
+	}
+)
+
+// identifier matches keys that need no quoting in a JSON path
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("values do not match values.schema.json:\n  - %s", strings.Join(e.Violations, "\n  - "))
+}
+
+// LoadChart reads the values.yaml and values.schema.json of a chart
+// directory or archive, nil if the chart is not available locally
+func LoadChart(path string) (*Chart, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read chart: %s", err)
+	}
+
+	files := map[string][]byte{}
+	if info.IsDir() {
+		for _, name := range []string{"values.yaml", "values.schema.json"} {
+			data, err := ioutil.ReadFile(filepath.Join(path, name))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("unable to read chart: %s", err)
+			}
+			files[name] = data
+		}
+	} else {
+		files, err = readArchive(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read chart archive: %s", err)
+		}
+	}
+
+	chart := &Chart{Values: map[string]interface{}{}, Schema: files["values.schema.json"]}
+	err = yaml.Unmarshal(files["values.yaml"], &chart.Values)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse chart values: %s", err)
+	}
+	if chart.Values == nil {
+		chart.Values = map[string]interface{}{}
+	}
+	return chart, nil
+}
+
+// readArchive returns the values.yaml and values.schema.json of the top
+// level chart of a packaged chart
+func readArchive(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+		split := strings.Split(strings.TrimPrefix(header.Name, "./"), "/")
+		if len(split) != 2 || (split[1] != "values.yaml" && split[1] != "values.schema.json") {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[split[1]] = data
+	}
+}
+
+// Merge merges the values like `helm upgrade`: the values files in order,
+// then the `--set` and the `--set-string` expressions, coalesced with the
+// chart defaults
+func Merge(defaults map[string]interface{}, files, set, setString []string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read values file: %s", err)
+		}
+		current := map[string]interface{}{}
+		err = yaml.Unmarshal(data, &current)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse values file %s: %s", file, err)
+		}
+		values = mergeMaps(values, current)
+	}
+	for _, expr := range set {
+		err := ParseSet(expr, values)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse --set %s: %s", expr, err)
+		}
+	}
+	for _, expr := range setString {
+		err := ParseSetString(expr, values)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse --set-string %s: %s", expr, err)
+		}
+	}
+	return coalesce(values, copyMap(defaults)), nil
+}
+
+// mergeMaps merges b into a, maps are merged recursively and other values
+// of b replace the values of a
+func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(a))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		if v, ok := v.(map[string]interface{}); ok {
+			if bv, ok := out[k].(map[string]interface{}); ok {
+				out[k] = mergeMaps(bv, v)
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// coalesce fills values with the defaults, a null value removes the
+// default and tables are only merged with tables
+func coalesce(values, defaults map[string]interface{}) map[string]interface{} {
+	for key, def := range defaults {
+		value, ok := values[key]
+		switch {
+		case !ok:
+			values[key] = def
+		case value == nil:
+			delete(values, key)
+		default:
+			dst, dstTable := value.(map[string]interface{})
+			src, srcTable := def.(map[string]interface{})
+			if dstTable && srcTable {
+				coalesce(dst, src)
+			}
+		}
+	}
+	return values
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if inner, ok := v.(map[string]interface{}); ok {
+			v = copyMap(inner)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// Validate validates the values against the JSON schema like helm and
+// returns all violations with their JSON path
+func Validate(schema []byte, values map[string]interface{}) error {
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("unable to render values: %s", err)
+	}
+	valuesJSON, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return fmt.Errorf("unable to render values: %s", err)
+	}
+	if bytes.Equal(valuesJSON, []byte("null")) {
+		valuesJSON = []byte("{}")
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(valuesJSON))
+	if err != nil {
+		return fmt.Errorf("unable to validate values: %s", err)
+	}
+	if result.Valid() {
+		return nil
+	}
+	violations := []string{}
+	for _, desc := range result.Errors() {
+		violations = append(violations, fmt.Sprintf("%s: %s", jsonPath(desc.Context()), desc.Description()))
+	}
+	sort.Strings(violations)
+	return &SchemaError{Violations: violations}
+}
+
+// jsonPath converts the context of a violation to a JSON path like
+// `$.image.tag`, `$.hosts[0]` or `$.annotations["example.com/name"]`
+func jsonPath(context *gojsonschema.JsonContext) string {
+	// keys may contain dots, so NUL separates the keys instead
+	path := strings.Split(context.String("\x00"), "\x00")
+	out := "$"
+	for _, key := range path[1:] {
+		if _, err := strconv.Atoi(key); err == nil {
+			out += fmt.Sprintf("[%s]", key)
+		} else if identifier.MatchString(key) {
+			out += "." + key
+		} else {
+			out += fmt.Sprintf("[%q]", key)
+		}
+	}
+	return out
+}
@@ -0,0 +1,204 @@
+package values
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"sigs.k8s.io/yaml"
+)
+
+const testSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "required": ["image", "replicas"],
+  "properties": {
+    "image": {
+      "type": "object",
+      "required": ["repository", "tag"],
+      "properties": {
+        "repository": {"type": "string"},
+        "tag": {"type": "string"}
+      }
+    },
+    "replicas": {"type": "integer", "minimum": 1},
+    "hosts": {"type": "array", "items": {"type": "string", "format": "hostname"}},
+    "annotations": {"type": "object", "additionalProperties": {"type": "string"}}
+  }
+}`
+
+const testDefaults = `image:
+  repository: app
+  tag: latest
+replicas: 1
+hosts: []
+`
+
+func TestLoadChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-helm3")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	chartDir := filepath.Join(dir, "app")
+	err = os.Mkdir(chartDir, 0700)
+	if err != nil {
+		t.Fatalf("unable to create chart dir: %s", err)
+	}
+	files := map[string]string{"values.yaml": testDefaults, "values.schema.json": testSchema}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(chartDir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("unable to write chart file: %s", err)
+		}
+	}
+
+	// the archive also contains a subchart which has to be ignored
+	archive := filepath.Join(dir, "app-1.0.0.tgz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("unable to create archive: %s", err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	files["charts/sub/values.yaml"] = "sub: true\n"
+	for name, content := range files {
+		_ = tw.WriteHeader(&tar.Header{Name: "app/" + name, Mode: 0600, Size: int64(len(content))})
+		_, _ = tw.Write([]byte(content))
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+	_ = f.Close()
+
+	want := &Chart{
+		Values: map[string]interface{}{
+			"image":    map[string]interface{}{"repository": "app", "tag": "latest"},
+			"replicas": float64(1),
+			"hosts":    []interface{}{},
+		},
+		Schema: []byte(testSchema),
+	}
+	for _, path := range []string{chartDir, archive} {
+		t.Logf("loading %s", path)
+		chart, err := LoadChart(path)
+		if err != nil {
+			t.Fatalf("unable to load chart: %s", err)
+		}
+		if diff := cmp.Diff(want, chart); diff != "" {
+			t.Fatalf("unexpected chart:\n%s", diff)
+		}
+	}
+
+	chart, err := LoadChart("bitnami/nginx")
+	if err != nil || chart != nil {
+		t.Fatalf("remote charts are not loaded: %v, %v", chart, err)
+	}
+}
+
+func TestMergeAndValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-helm3")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		err := ioutil.WriteFile(file, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("unable to write values file: %s", err)
+		}
+		return file
+	}
+	base := write("base.yaml", "image:\n  tag: v1\nannotations:\n  team: web\n")
+	prod := write("prod.yaml", "replicas: 3\nhosts: [example.com]\n")
+	unset := write("unset.yaml", "hosts: null\n")
+
+	defaults := map[string]interface{}{}
+	err = yaml.Unmarshal([]byte(testDefaults), &defaults)
+	if err != nil {
+		t.Fatalf("unable to parse defaults: %s", err)
+	}
+	chart := &Chart{Values: defaults, Schema: []byte(testSchema)}
+
+	tests := []struct {
+		name      string
+		files     []string
+		set       []string
+		setString []string
+		values    map[string]interface{}
+		err       error
+	}{
+		{
+			name:  "files override defaults",
+			files: []string{base, prod},
+			values: map[string]interface{}{
+				"image":       map[string]interface{}{"repository": "app", "tag": "v1"},
+				"replicas":    float64(3),
+				"hosts":       []interface{}{"example.com"},
+				"annotations": map[string]interface{}{"team": "web"},
+			},
+		},
+		{
+			name:      "set overrides files and set-string overrides set",
+			files:     []string{base},
+			set:       []string{"replicas=2,image.tag=v2"},
+			setString: []string{"image.tag=v3"},
+			values: map[string]interface{}{
+				"image":       map[string]interface{}{"repository": "app", "tag": "v3"},
+				"replicas":    int64(2),
+				"hosts":       []interface{}{},
+				"annotations": map[string]interface{}{"team": "web"},
+			},
+		},
+		{
+			name:  "null removes defaults",
+			files: []string{unset},
+			values: map[string]interface{}{
+				"image":    map[string]interface{}{"repository": "app", "tag": "latest"},
+				"replicas": float64(1),
+			},
+		},
+		{
+			name: "all violations",
+			set:  []string{"replicas=0,image.tag=1,hosts={example.com,not_a_host},annotations.example\\.com/count=2"},
+			err: fmt.Errorf("values do not match values.schema.json:\n" +
+				"  - $.annotations[\"example.com/count\"]: Invalid type. Expected: string, given: integer\n" +
+				"  - $.hosts[1]: Does not match format 'hostname'\n" +
+				"  - $.image.tag: Invalid type. Expected: string, given: integer\n" +
+				"  - $.replicas: Must be greater than or equal to 1"),
+		},
+		{
+			name: "missing required value",
+			set:  []string{"image=null"},
+			err:  fmt.Errorf("values do not match values.schema.json:\n  - $: image is required"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		values, err := Merge(chart.Values, test.files, test.set, test.setString)
+		if err != nil {
+			t.Fatalf("unable to merge values: %s", err)
+		}
+		err = Validate(chart.Schema, values)
+		if !errEq(err, test.err) {
+			t.Fatalf("unexpected validation result:\n- %v\n+ %v", test.err, err)
+		} else if err != nil {
+			continue
+		}
+		if diff := cmp.Diff(test.values, values); diff != "" {
+			t.Fatalf("unexpected values:\n%s", diff)
+		}
+	}
+
+	if diff := cmp.Diff(map[string]interface{}{"repository": "app", "tag": "latest"}, defaults["image"]); diff != "" {
+		t.Fatalf("defaults were modified:\n%s", diff)
+	}
+}
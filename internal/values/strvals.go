@@ -0,0 +1,294 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Modified from helm.sh/helm/v3/pkg/strvals/parser.go: reduced to the
+// `--set` and `--set-string` parsing into a values map.
+
+package values
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// setParser parses the `--set` and `--set-string` syntax of helm like
+// `a.b=c,list={1,2},items[0].name=x` into a values map
+type setParser struct {
+	sc     *strings.Reader
+	data   map[string]interface{}
+	strict bool
+}
+
+const (
+	// maxIndex limits list indexes like helm does
+	maxIndex = 65536
+	// maxNestedNameLevel limits the nesting of keys like helm does
+	maxNestedNameLevel = 30
+)
+
+var errNotList = errors.New("not a list")
+
+// ParseSet merges a `--set` expression into dest, values are typed like helm
+// types them
+func ParseSet(expr string, dest map[string]interface{}) error {
+	return (&setParser{sc: strings.NewReader(expr), data: dest}).parse()
+}
+
+// ParseSetString merges a `--set-string` expression into dest, all values
+// are strings
+func ParseSetString(expr string, dest map[string]interface{}) error {
+	return (&setParser{sc: strings.NewReader(expr), data: dest, strict: true}).parse()
+}
+
+func (p *setParser) parse() error {
+	for {
+		err := p.key(p.data, 0)
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+}
+
+func (p *setParser) key(data map[string]interface{}, level int) error {
+	k, last, err := runesUntil(p.sc, "=[,.")
+	switch {
+	case err != nil:
+		if len(k) == 0 {
+			return err
+		}
+		return fmt.Errorf("key %q has no value", k)
+	case last == '[':
+		i, err := p.keyIndex()
+		if err != nil {
+			return fmt.Errorf("error parsing index: %s", err)
+		}
+		list, _ := data[k].([]interface{})
+		list, err = p.listItem(list, i, level)
+		set(data, k, list)
+		return err
+	case last == '=':
+		values, err := p.valueList()
+		switch err {
+		case nil:
+			set(data, k, values)
+			return nil
+		case io.EOF:
+			set(data, k, "")
+			return err
+		case errNotList:
+			value, err := runesUntilStop(p.sc, ",")
+			if err != nil && err != io.EOF {
+				return err
+			}
+			set(data, k, p.typed(value))
+			return nil
+		default:
+			return err
+		}
+	case last == ',':
+		set(data, k, "")
+		return fmt.Errorf("key %q has no value (cannot end with ,)", k)
+	default:
+		level++
+		if level > maxNestedNameLevel {
+			return fmt.Errorf("value name nested level is greater than maximum supported nested level of %d", maxNestedNameLevel)
+		}
+		inner, ok := data[k].(map[string]interface{})
+		if !ok {
+			inner = map[string]interface{}{}
+		}
+		err := p.key(inner, level)
+		if err == nil && len(inner) == 0 {
+			return fmt.Errorf("key map %q has no value", k)
+		}
+		if len(inner) != 0 {
+			set(data, k, inner)
+		}
+		return err
+	}
+}
+
+func (p *setParser) keyIndex() (int, error) {
+	v, _, err := runesUntil(p.sc, "]")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+func (p *setParser) listItem(list []interface{}, i, level int) ([]interface{}, error) {
+	if i < 0 {
+		return list, fmt.Errorf("negative %d index not allowed", i)
+	}
+	k, last, err := runesUntil(p.sc, "[.=")
+	switch {
+	case len(k) > 0:
+		return list, fmt.Errorf("unexpected data at end of array index: %q", k)
+	case err != nil:
+		return list, err
+	case last == '=':
+		values, err := p.valueList()
+		switch err {
+		case nil:
+			return setIndex(list, i, values)
+		case io.EOF:
+			return setIndex(list, i, "")
+		case errNotList:
+			value, err := runesUntilStop(p.sc, ",")
+			if err != nil && err != io.EOF {
+				return list, err
+			}
+			return setIndex(list, i, p.typed(value))
+		default:
+			return list, err
+		}
+	case last == '[':
+		next, err := p.keyIndex()
+		if err != nil {
+			return list, fmt.Errorf("error parsing index: %s", err)
+		}
+		var inner []interface{}
+		if len(list) > i {
+			inner, _ = list[i].([]interface{})
+		}
+		inner, err = p.listItem(inner, next, level)
+		if err != nil {
+			return list, err
+		}
+		return setIndex(list, i, inner)
+	default:
+		var inner map[string]interface{}
+		if len(list) > i {
+			inner, _ = list[i].(map[string]interface{})
+		}
+		if inner == nil {
+			inner = map[string]interface{}{}
+		}
+		err := p.key(inner, level)
+		if err != nil {
+			return list, err
+		}
+		return setIndex(list, i, inner)
+	}
+}
+
+// valueList parses a `{a,b}` list, errNotList if the value is no list
+func (p *setParser) valueList() ([]interface{}, error) {
+	r, _, err := p.sc.ReadRune()
+	if err != nil {
+		return []interface{}{}, err
+	}
+	if r != '{' {
+		_ = p.sc.UnreadRune()
+		return []interface{}{}, errNotList
+	}
+	list := []interface{}{}
+	for {
+		value, last, err := runesUntil(p.sc, ",}")
+		switch {
+		case err == io.EOF:
+			return list, errors.New("list must terminate with '}'")
+		case err != nil:
+			return list, err
+		case last == '}':
+			// a trailing comma separates the next key
+			if r, _, err := p.sc.ReadRune(); err == nil && r != ',' {
+				_ = p.sc.UnreadRune()
+			}
+			return append(list, p.typed(value)), nil
+		default:
+			list = append(list, p.typed(value))
+		}
+	}
+}
+
+// typed converts the value like helm, booleans, null and integers are typed
+// unless strict, floats stay strings
+func (p *setParser) typed(value string) interface{} {
+	if p.strict {
+		return value
+	}
+	switch {
+	case strings.EqualFold(value, "true"):
+		return true
+	case strings.EqualFold(value, "false"):
+		return false
+	case strings.EqualFold(value, "null"):
+		return nil
+	case value == "0":
+		return int64(0)
+	}
+	// leading zeros keep the value a string
+	if value != "" && value[0] != '0' {
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+	}
+	return value
+}
+
+func set(data map[string]interface{}, key string, value interface{}) {
+	if key == "" {
+		return
+	}
+	data[key] = value
+}
+
+func setIndex(list []interface{}, i int, value interface{}) ([]interface{}, error) {
+	if i >= maxIndex {
+		return list, fmt.Errorf("index of %d is greater than maximum supported index of %d", i, maxIndex)
+	}
+	for len(list) <= i {
+		list = append(list, nil)
+	}
+	list[i] = value
+	return list, nil
+}
+
+// runesUntil reads until one of the stop runes, backslashes escape the next
+// rune
+func runesUntil(sc *strings.Reader, stop string) (string, rune, error) {
+	v := []rune{}
+	for {
+		r, _, err := sc.ReadRune()
+		switch {
+		case err != nil:
+			return string(v), r, err
+		case strings.ContainsRune(stop, r):
+			return string(v), r, nil
+		case r == '\\':
+			next, _, err := sc.ReadRune()
+			if err != nil {
+				return string(v), next, err
+			}
+			v = append(v, next)
+		default:
+			v = append(v, r)
+		}
+	}
+}
+
+func runesUntilStop(sc *strings.Reader, stop string) (string, error) {
+	v, _, err := runesUntil(sc, stop)
+	return v, err
+}
@@ -0,0 +1,93 @@
+package values
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSet(t *testing.T) {
+	tests := []struct {
+		name   string
+		expr   string
+		str    bool
+		values map[string]interface{}
+		err    error
+	}{
+		{
+			name:   "typed values",
+			expr:   "a=1,b=true,c=null,d=007,e=1.5,f=0,g=",
+			values: map[string]interface{}{"a": int64(1), "b": true, "c": nil, "d": "007", "e": "1.5", "f": int64(0), "g": ""},
+		},
+		{
+			name:   "string values",
+			expr:   "a=1,b=true",
+			str:    true,
+			values: map[string]interface{}{"a": "1", "b": "true"},
+		},
+		{
+			name:   "nested keys",
+			expr:   "image.repository=app,image.tag=v1",
+			values: map[string]interface{}{"image": map[string]interface{}{"repository": "app", "tag": "v1"}},
+		},
+		{
+			name:   "escaped separators",
+			expr:   `annotations.example\.com/name=a\,b`,
+			values: map[string]interface{}{"annotations": map[string]interface{}{"example.com/name": "a,b"}},
+		},
+		{
+			name:   "lists",
+			expr:   "hosts={a,b},ports={80,443},other=x",
+			values: map[string]interface{}{"hosts": []interface{}{"a", "b"}, "ports": []interface{}{int64(80), int64(443)}, "other": "x"},
+		},
+		{
+			name: "list indexes",
+			expr: "ingress[1].host=example.com,matrix[0][1]=x",
+			values: map[string]interface{}{
+				"ingress": []interface{}{nil, map[string]interface{}{"host": "example.com"}},
+				"matrix":  []interface{}{[]interface{}{nil, "x"}},
+			},
+		},
+		{
+			name: "missing value",
+			expr: "a",
+			err:  fmt.Errorf("key \"a\" has no value"),
+		},
+		{
+			name: "unterminated list",
+			expr: "a={1,2",
+			err:  fmt.Errorf("list must terminate with '}'"),
+		},
+		{
+			name: "negative index",
+			expr: "a[-1]=x",
+			err:  fmt.Errorf("negative -1 index not allowed"),
+		},
+		{
+			name: "nested too deep",
+			expr: strings.Repeat("a.", 31) + "a=x",
+			err:  fmt.Errorf("value name nested level is greater than maximum supported nested level of 30"),
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		values := map[string]interface{}{}
+		var err error
+		if test.str {
+			err = ParseSetString(test.expr, values)
+		} else {
+			err = ParseSet(test.expr, values)
+		}
+		if !errEq(err, test.err) {
+			t.Fatalf("unable to parse:\n- %v\n+ %v", test.err, err)
+		} else if err != nil {
+			continue
+		}
+		if diff := cmp.Diff(test.values, values); diff != "" {
+			t.Fatalf("unexpected values:\n%s", diff)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package values
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/drone/envsubst"
+	"github.com/drone/envsubst/parse"
+)
+
+type (
+	// Substituter replaces ${var} references with values from the
+	// environment
+	Substituter struct {
+		Strict   bool
+		Prefixes []string
+		TempDir  string
+
+		lookup func(string) (string, bool)
+	}
+
+	SubstOption func(*Substituter)
+)
+
+// WithStrict fails the substitution if a referenced variable is not defined
+func WithStrict(strict bool) SubstOption {
+	return func(s *Substituter) {
+		s.Strict = strict
+	}
+}
+
+// WithPrefixes limits the substitution to variables starting with one of
+// the prefixes, an empty list allows all variables
+func WithPrefixes(prefixes []string) SubstOption {
+	return func(s *Substituter) {
+		s.Prefixes = prefixes
+	}
+}
+
+// WithTempDir sets the directory rendered values files are written to
+func WithTempDir(dir string) SubstOption {
+	return func(s *Substituter) {
+		s.TempDir = dir
+	}
+}
+
+// WithLookup replaces the environment lookup, mainly used for testing
+func WithLookup(lookup func(string) (string, bool)) SubstOption {
+	return func(s *Substituter) {
+		s.lookup = lookup
+	}
+}
+
+func NewSubstituter(options ...SubstOption) *Substituter {
+	s := &Substituter{
+		lookup: os.LookupEnv,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// defaults are the operators that substitute a value of their own if the
+// variable is not set, like `${VAR:-default}`
+var defaults = map[string]bool{"-": true, ":-": true, "=": true, ":=": true, "+": true, ":+": true}
+
+// Eval substitutes all variables in input, variables with a default are
+// neither undefined nor denied
+func (s *Substituter) Eval(input string) (string, error) {
+	tree, err := parse.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	required := map[string]bool{}
+	requiredVars(tree.Root, required)
+
+	undefined := map[string]bool{}
+	denied := map[string]bool{}
+	output, err := envsubst.Eval(input, func(name string) string {
+		if !s.allowed(name) {
+			if required[name] {
+				denied[name] = true
+			}
+			return ""
+		}
+		value, ok := s.lookup(name)
+		if !ok && required[name] {
+			undefined[name] = true
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(denied) > 0 {
+		return "", fmt.Errorf("variables not allowed by prefixes %v: %s", s.Prefixes, joinKeys(denied))
+	}
+	if s.Strict && len(undefined) > 0 {
+		return "", fmt.Errorf("undefined variables: %s", joinKeys(undefined))
+	}
+	return output, nil
+}
+
+// requiredVars collects the variables referenced without a default
+func requiredVars(node parse.Node, required map[string]bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		for _, n := range node.Nodes {
+			requiredVars(n, required)
+		}
+	case *parse.FuncNode:
+		if !defaults[node.Name] {
+			required[node.Param] = true
+		}
+		for _, n := range node.Args {
+			requiredVars(n, required)
+		}
+	}
+}
+
+// EvalFile substitutes all variables in the file and writes the result into
+// a temporary copy in TempDir, the path to the copy is returned. The caller
+// removes the copy.
+func (s *Substituter) EvalFile(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read values file: %s", err)
+	}
+	rendered, err := s.Eval(string(data))
+	if err != nil {
+		return "", fmt.Errorf("unable to envsubst %s: %s", file, err)
+	}
+	pattern := fmt.Sprintf("*-%s", filepath.Base(file))
+	f, err := ioutil.TempFile(s.TempDir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("unable to create rendered values file: %s", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(rendered)
+	if err != nil {
+		return "", fmt.Errorf("unable to write rendered values file: %s", err)
+	}
+	return f.Name(), nil
+}
+
+func (s *Substituter) allowed(name string) bool {
+	if len(s.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinKeys(m map[string]bool) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
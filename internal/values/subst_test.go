@@ -0,0 +1,133 @@
+package values
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSubstituter(t *testing.T) {
+	env := map[string]string{
+		"DRONE_COMMIT_SHA": "21ffea3",
+		"DRONE_TAG":        "v1.2.3",
+		"SECRET_TOKEN":     "hunter2",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name    string
+		options []SubstOption
+		input   string
+		want    string
+		err     error
+	}{
+		{
+			name:  "substitute defined variable",
+			input: "app.commit=${DRONE_COMMIT_SHA}",
+			want:  "app.commit=21ffea3",
+		},
+		{
+			name:  "substitute undefined variable",
+			input: "app.commit=${DRONE_MISSING}",
+			want:  "app.commit=",
+		},
+		{
+			name:    "strict with undefined variables",
+			options: []SubstOption{WithStrict(true)},
+			input:   "a: ${DRONE_MISSING}\nb: ${DRONE_TAG}\nc: ${ALSO_MISSING}",
+			err:     fmt.Errorf("undefined variables: ALSO_MISSING, DRONE_MISSING"),
+		},
+		{
+			name:    "strict with defined variables",
+			options: []SubstOption{WithStrict(true)},
+			input:   "tag: ${DRONE_TAG/v/}",
+			want:    "tag: 1.2.3",
+		},
+		{
+			name:    "strict with defaults",
+			options: []SubstOption{WithStrict(true)},
+			input:   "a: ${DRONE_MISSING:-x}\nb: ${DRONE_MISSING=y}",
+			want:    "a: x\nb: y",
+		},
+		{
+			name:    "strict with default and plain reference",
+			options: []SubstOption{WithStrict(true)},
+			input:   "a: ${DRONE_MISSING:-x}\nb: ${DRONE_MISSING}",
+			err:     fmt.Errorf("undefined variables: DRONE_MISSING"),
+		},
+		{
+			name:    "prefixes allow variable",
+			options: []SubstOption{WithPrefixes([]string{"DRONE_"})},
+			input:   "tag: ${DRONE_TAG}",
+			want:    "tag: v1.2.3",
+		},
+		{
+			name:    "prefixes deny variable",
+			options: []SubstOption{WithPrefixes([]string{"DRONE_"})},
+			input:   "token: ${SECRET_TOKEN}",
+			err:     fmt.Errorf("variables not allowed by prefixes [DRONE_]: SECRET_TOKEN"),
+		},
+		{
+			name:    "prefixes with default",
+			options: []SubstOption{WithPrefixes([]string{"DRONE_"}), WithStrict(true)},
+			input:   "token: ${SECRET_TOKEN:-none}",
+			want:    "token: none",
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("running #%d: %s", i, test.name)
+		s := NewSubstituter(append(test.options, WithLookup(lookup))...)
+		got, err := s.Eval(test.input)
+		if !errEq(err, test.err) {
+			t.Fatalf("unable to substitute:\n- %v\n+ %v", test.err, err)
+		} else if err != nil {
+			continue
+		}
+		if got != test.want {
+			t.Fatalf("unexpected output:\n- %q\n+ %q", test.want, got)
+		}
+	}
+}
+
+func TestSubstituterFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-helm3")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "values.yaml")
+	err = ioutil.WriteFile(file, []byte("commit: ${DRONE_COMMIT_SHA}\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write values file: %s", err)
+	}
+
+	s := NewSubstituter(
+		WithTempDir(dir),
+		WithLookup(func(name string) (string, bool) { return "21ffea3", true }),
+	)
+	rendered, err := s.EvalFile(file)
+	if err != nil {
+		t.Fatalf("unable to substitute file: %s", err)
+	}
+	if rendered == file {
+		t.Fatalf("rendered file must be a copy")
+	}
+	data, err := ioutil.ReadFile(rendered)
+	if err != nil {
+		t.Fatalf("unable to read rendered file: %s", err)
+	}
+	if got := string(data); got != "commit: 21ffea3\n" {
+		t.Fatalf("unexpected rendered file: %q", got)
+	}
+}
+
+func errEq(a error, b error) bool {
+	return fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b)
+}
@@ -1,27 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/drone/envsubst"
 	"github.com/jinzhu/copier"
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
 
+	"github.com/bitsbeats/drone-helm3/internal/core"
 	"github.com/bitsbeats/drone-helm3/internal/errorhandler"
+	"github.com/bitsbeats/drone-helm3/internal/freeze"
 	"github.com/bitsbeats/drone-helm3/internal/helm"
 	"github.com/bitsbeats/drone-helm3/internal/kube"
+	"github.com/bitsbeats/drone-helm3/internal/policy"
+	"github.com/bitsbeats/drone-helm3/internal/redact"
+	"github.com/bitsbeats/drone-helm3/internal/values"
 )
 
 type (
 	Config struct {
 		PreCommands     string `envconfig:"PRE_COMMANDS" default:""`                  // can be used to run custom code, for example gcloud auth
+		CommandsStrict  bool   `envconfig:"COMMANDS_STRICT" default:"true"`           // run pre commands and hooks with set -euo pipefail
 		KubeSkip        bool   `envconfig:"KUBE_SKIP" default:"false"`                // skip creation of kubeconfig
 		KubeConfig      string `envconfig:"KUBE_CONFIG" default:"/root/.kube/config"` // path to kubeconfig
 		KubeApiServer   string `envconfig:"KUBE_API_SERVER"`                          // kubernetes api server
@@ -31,10 +42,12 @@ type (
 
 		PushGatewayURL string `envconfig:"PUSHGATEWAY_URL" default:""` // url to a prometheus pushgateway server
 
-		Mode      string `envconfig:"MODE" default:"installupgrade"` // changes helm operation mode
-		Chart     string `envconfig:"CHART"`                         // the helm chart to be deployed
-		Release   string `envconfig:"RELEASE" required:"true"`       // helm release name
-		Namespace string `envconfig:"NAMESPACE" required:"true"`     // kubernets and helm namespace
+		Mode         string `envconfig:"MODE" default:"installupgrade"` // changes helm operation mode
+		Chart        string `envconfig:"CHART"`                         // the helm chart to be deployed, oci:// references are supported
+		ChartVersion string `envconfig:"CHART_VERSION"`                 // chart version or semver constraint
+		ChartDevel   bool   `envconfig:"CHART_DEVEL" default:"false"`   // allow pre-release chart versions
+		Release      string `envconfig:"RELEASE"`                       // helm release name, required unless packaging
+		Namespace    string `envconfig:"NAMESPACE"`                     // kubernets and helm namespace, required unless packaging
 
 		Lint                     bool   `envconfig:"LINT" default:"true"`                        // helm lint option
 		Atomic                   bool   `envconfig:"ATOMIC" default:"true"`                      // helm atomic option
@@ -46,23 +59,95 @@ type (
 		DisableOpenAPIValidation bool   `envconfig:"DISABLE_OPENAPI_VALIDATION" default:"false"` // helm openapivalidation option
 		PostKustomization        string `envconfig:"POST_KUSTOMIZATION" default:""`              // runs a customization of the generated output
 
-		HelmRepos          []string `envconfig:"HELM_REPOS"`                          // additonal helm repos
-		BuildDependencies  bool     `envconfig:"BUILD_DEPENDENCIES" default:"true"`   // helm dependency build option
-		UpdateDependencies bool     `envconfig:"UPDATE_DEPENDENCIES" default:"false"` // helm dependency update option
-		Test               bool     `envconfig:"TEST" default:"false"`                // helm run tests
-		TestRollback       bool     `envconfig:"TEST_ROLLBACK" default:"false"`       // helm run tests and rollback on failure
+		RegistryLoginHost     string `envconfig:"REGISTRY_LOGIN_HOST"`                     // oci registry host, defaults to the host of an oci chart
+		RegistryLoginUsername string `envconfig:"REGISTRY_LOGIN_USERNAME"`                 // oci registry username, enables the registry login
+		RegistryLoginPassword string `envconfig:"REGISTRY_LOGIN_PASSWORD"`                 // oci registry password
+		RegistryLoginInsecure bool   `envconfig:"REGISTRY_LOGIN_INSECURE" default:"false"` // allow insecure connections to the oci registry
+		RegistryLoginCAFile   string `envconfig:"REGISTRY_LOGIN_CA_FILE"`                  // ca bundle to verify the oci registry
+
+		HelmRepos          string        `envconfig:"HELM_REPOS"`                          // additonal helm repos, name=url pairs or a yaml list of repos
+		BuildDependencies  bool          `envconfig:"BUILD_DEPENDENCIES" default:"true"`   // helm dependency build option
+		UpdateDependencies bool          `envconfig:"UPDATE_DEPENDENCIES" default:"false"` // helm dependency update option
+		Test               bool          `envconfig:"TEST" default:"false"`                // helm run tests
+		TestRollback       bool          `envconfig:"TEST_ROLLBACK" default:"false"`       // helm run tests and rollback on failure
+		TestTimeout        time.Duration `envconfig:"TEST_TIMEOUT" default:"5m"`           // timeout for helm test
+		TestFilter         []string      `envconfig:"TEST_FILTER"`                         // only run the tests with these names
+		TestReportFile     string        `envconfig:"TEST_REPORT_FILE"`                    // write a junit xml report of the tests to this file
+		RollbackWait       bool          `envconfig:"ROLLBACK_WAIT" default:"true"`        // wait for the rollback to finish
+		RollbackOnFailure  bool          `envconfig:"ROLLBACK_ON_FAILURE"`                 // roll back to the last deployed revision on any failure after the upgrade started
+		RecoverPending     bool          `envconfig:"RECOVER_PENDING"`                     // roll back or uninstall a release stuck in a pending state before the upgrade
+		VerifyRollout      bool          `envconfig:"VERIFY_ROLLOUT"`                      // check the rollout of the workloads after the upgrade
+		VerifyTimeout      time.Duration `envconfig:"VERIFY_TIMEOUT" default:"5m"`         // timeout for the rollout check of each workload
+		Diagnostics        bool          `envconfig:"DIAGNOSTICS" default:"true"`          // collect events, pod states and logs if the deployment fails
+		DiagnosticsFile    string        `envconfig:"DIAGNOSTICS_FILE"`                    // write the full diagnostics to this file
+		DiagnosticsLogs    int           `envconfig:"DIAGNOSTICS_LOG_LINES" default:"50"`  // number of log lines of crashing containers
+		SmokeChecks        string        `envconfig:"SMOKE_CHECKS"`                        // yaml list of http checks run after the deployment
+		SmokeRollback      bool          `envconfig:"SMOKE_ROLLBACK"`                      // rollback if the smoke checks fail
 
 		Envsubst             bool     `envconfig:"ENVSUBST" default:"false"`                // allow envsubst on Values und ValuesString
+		EnvsubstFiles        bool     `envconfig:"ENVSUBST_FILES" default:"false"`          // allow envsubst on the content of ValuesYaml files
+		EnvsubstStrict       bool     `envconfig:"ENVSUBST_STRICT" default:"false"`         // fail envsubst on undefined variables
+		EnvsubstPrefixes     []string `envconfig:"ENVSUBST_PREFIXES"`                       // only allow envsubst of variables with these prefixes
 		Values               []string `envconfig:"VALUES"`                                  // additional --set options
 		ValuesString         []string `envconfig:"VALUES_STRING"`                           // additional --set-string options
 		ValuesYaml           string   `envconfig:"VALUES_YAML"`                             // additonal values files
 		ValuesYamlAddDefault bool     `envconfig:"VALUES_YAML_ADD_DEFAULT" default:"false"` // re add the default values.yaml as first option
 
-		Timeout time.Duration `envconfig:"TIMEOUT" default:"15m"` // timeout for helm command
-		Debug   bool          `envconfig:"DEBUG" default:"false"` // debug configuration
+		SchemaValidation bool `envconfig:"SCHEMA_VALIDATION" default:"true"` // validate the values against values.schema.json before contacting the cluster
+		SchemaRequired   bool `envconfig:"SCHEMA_REQUIRED" default:"false"`  // fail for charts without values.schema.json or that cannot be validated
+
+		InjectBuildMetadata bool   `envconfig:"INJECT_BUILD_METADATA" default:"false"`         // add drone build metadata to values and release description
+		BuildMetadataKey    string `envconfig:"BUILD_METADATA_KEY" default:"deployment.drone"` // values key the build metadata is added below
+
+		PackageDestination string `envconfig:"PACKAGE_DESTINATION"` // directory the packaged chart is written to
+		PackageSignKey     string `envconfig:"PACKAGE_SIGN_KEY"`    // name of the gpg key to sign the package with
+		PackageKeyring     string `envconfig:"PACKAGE_KEYRING"`     // path to the gpg keyring
+		PackagePassphrase  string `envconfig:"PACKAGE_PASSPHRASE"`  // passphrase of the gpg key
+		PackagePush        string `envconfig:"PACKAGE_PUSH"`        // oci:// registry or chartmuseum upload url the package is pushed to
+
+		PostCommands       string        `envconfig:"POST_COMMANDS"`             // runs after a successful deployment, failures fail the build
+		OnSuccessCommands  string        `envconfig:"ON_SUCCESS_COMMANDS"`       // runs after the build succeeded
+		OnFailureCommands  string        `envconfig:"ON_FAILURE_COMMANDS"`       // runs after the build failed
+		OnRollbackCommands string        `envconfig:"ON_ROLLBACK_COMMANDS"`      // runs after a rollback
+		HookTimeout        time.Duration `envconfig:"HOOK_TIMEOUT" default:"5m"` // timeout for each of the hook commands
+
+		CacheDir     string        `envconfig:"CACHE_DIR"`                   // directory to keep helm repositories and dependencies between builds
+		RepoCacheTTL time.Duration `envconfig:"REPO_CACHE_TTL" default:"1h"` // maximum age of cached repository indexes
+
+		CancelGracePeriod time.Duration `envconfig:"CANCEL_GRACE_PERIOD" default:"30s"` // time helm gets to exit after SIGTERM before it is killed
+		CancelCleanup     string        `envconfig:"CANCEL_CLEANUP" default:"none"`     // cleanup after a cancellation, none or rollback
+		CancelTimeout     time.Duration `envconfig:"CANCEL_TIMEOUT" default:"5m"`       // timeout for the cleanup and hooks after a cancellation
+
+		RetryAttempts int           `envconfig:"RETRY_ATTEMPTS" default:"3"` // attempts for idempotent phases failing with transient errors
+		RetryBackoff  time.Duration `envconfig:"RETRY_BACKOFF" default:"2s"` // wait before the first retry, doubled for each retry
+		RetryUpgrade  bool          `envconfig:"RETRY_UPGRADE"`              // also retry the upgrade on transient errors
+
+		Lock         bool          `envconfig:"LOCK"`                       // serialize deployments of the release with a lease
+		LockTimeout  time.Duration `envconfig:"LOCK_TIMEOUT" default:"10m"` // maximum wait for a lock held by another build
+		LockDuration time.Duration `envconfig:"LOCK_DURATION" default:"1m"` // lifetime of the lease, renewed while the build runs
+
+		ManifestChecks         string   `envconfig:"MANIFEST_CHECKS"`          // severity of the checks of the rendered manifest, e.g. latest-tag=deny,resources=warn
+		ManifestRequiredLabels []string `envconfig:"MANIFEST_REQUIRED_LABELS"` // labels required by the required-labels check
+
+		PolicyFile string `envconfig:"POLICY_FILE"` // additional policy file limiting namespaces, releases, charts and events
+		Policy     string `envconfig:"POLICY"`      // additional policy as YAML, e.g. from a secret
+
+		FreezeWindows  string `envconfig:"FREEZE_WINDOWS"`  // cron-like or date range windows blocking deployments, separated by newlines
+		FreezeOverride bool   `envconfig:"FREEZE_OVERRIDE"` // deploy even if a freeze window is active
+
+		Timeout       time.Duration `envconfig:"TIMEOUT" default:"15m"` // timeout for helm command
+		PhaseTimeouts string        `envconfig:"PHASE_TIMEOUTS"`        // timeouts of the individual phases, e.g. repo-update=2m,upgrade=20m
+		Debug         bool          `envconfig:"DEBUG" default:"false"` // debug configuration
 
 		// auto-filled by drone
-		DroneRepo string `envconfig:"DRONE_REPO" required:"true"`
+		DroneRepo        string `envconfig:"DRONE_REPO" required:"true"`
+		DroneCommitSha   string `envconfig:"DRONE_COMMIT_SHA"`
+		DroneBranch      string `envconfig:"DRONE_COMMIT_BRANCH"`
+		DroneTag         string `envconfig:"DRONE_TAG"`
+		DroneBuildNumber string `envconfig:"DRONE_BUILD_NUMBER"`
+		DroneBuildLink   string `envconfig:"DRONE_BUILD_LINK"`
+		DroneBuildEvent  string `envconfig:"DRONE_BUILD_EVENT"`
+		DroneAuthor      string `envconfig:"DRONE_COMMIT_AUTHOR"`
 	}
 )
 
@@ -91,12 +176,17 @@ func main() {
 	} else {
 		eh = errorhandler.NewLog()
 	}
+	cleanup := errorhandler.NewCleanup(eh)
+	eh = cleanup
 
 	// debug
 	if cfg.Debug {
 		debugCfg := Config{}
 		_ = copier.Copy(&debugCfg, cfg)
 		debugCfg.KubeToken = "***"
+		debugCfg.RegistryLoginPassword = "***"
+		debugCfg.PackagePassphrase = "***"
+		debugCfg.HelmRepos = maskHelmRepos(cfg.HelmRepos)
 		for i, val := range debugCfg.Values {
 			kv := strings.SplitN(val, "=", 2)
 			debugCfg.Values[i] = fmt.Sprintf("%s=***", kv[0])
@@ -108,29 +198,172 @@ func main() {
 		log.Printf("configuration: %+v", debugCfg)
 	}
 
+	// deployment freeze
+	if cfg.Mode != "package" {
+		windows, err := freeze.Parse(cfg.FreezeWindows)
+		if err != nil {
+			eh.Fatalf("unable to parse freeze windows: %s", err)
+		}
+		err = freeze.NewChecker(windows, freeze.WithOverride(cfg.FreezeOverride)).Check()
+		if err != nil {
+			eh.Status(helm.Wrap(err, "deployment frozen", core.FrozenErrorKind), "%s", err)
+		}
+	}
+
+	phaseTimeouts, err := helm.ParsePhaseTimeouts(cfg.PhaseTimeouts)
+	if err != nil {
+		eh.Fatalf("unable to parse phase timeouts: %s", err)
+	}
+
+	// everything is bound to the plugin context
+	ctx, cancel := context.WithTimeout(context.Background(), helm.RunTimeout(cfg.Timeout, phaseTimeouts))
+	defer cancel()
+
+	// drone sends SIGTERM if the build is cancelled, the runner forwards it
+	// to the running command
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("received %s, cancelling", sig)
+		cancel()
+	}()
+
+	repos, err := helm.ParseHelmRepos(cfg.HelmRepos)
+	if err != nil {
+		eh.Fatalf("unable to parse helm repos: %s", err)
+	}
+	smokeChecks, err := helm.ParseSmokeChecks(cfg.SmokeChecks)
+	if err != nil {
+		eh.Fatalf("unable to parse smoke checks: %s", err)
+	}
+	manifestRules, err := helm.ParseManifestChecks(cfg.ManifestChecks)
+	if err != nil {
+		eh.Fatalf("unable to parse manifest checks: %s", err)
+	}
+
+	// redact secrets from script output
+	secrets := []string{cfg.KubeToken, cfg.RegistryLoginPassword, cfg.PackagePassphrase}
+	for _, repo := range repos {
+		secrets = append(secrets, repo.Password)
+	}
+	stdout := redact.NewWriter(os.Stdout, secrets...)
+	stderr := redact.NewWriter(os.Stderr, secrets...)
+	script := func(name, body string) *Script {
+		return &Script{Name: name, Body: body, Strict: cfg.CommandsStrict, Stdout: stdout, Stderr: stderr}
+	}
+
+	// validations
+	deploy := cfg.Mode != "package"
+	if deploy && (cfg.Release == "" || cfg.Namespace == "") {
+		eh.Fatalf("release and namespace are required for mode %q", cfg.Mode)
+	}
+
+	// enforce policies before the pre commands run, they could change the
+	// policy files, and before any credentials are written
+	if deploy {
+		err = checkPolicies(cfg, repos)
+		if err != nil {
+			eh.Status(helm.Wrap(err, "policy denied", core.PreFailErrorKind), "denied by policy: %s", err)
+		}
+	}
+
 	// run pre commands if set
 	if cfg.PreCommands != "" {
-		scriptName := "/tmp/pre_commands.sh"
-		f, err := os.Create(scriptName)
+		preCtx, preCancel := ctx, func() {}
+		if timeout := phaseTimeouts[helm.PhasePreCommand]; timeout > 0 {
+			preCtx, preCancel = context.WithTimeout(ctx, timeout)
+		}
+		err = script("pre commands", cfg.PreCommands).Run(preCtx)
+		if err != nil && preCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			err = &helm.PhaseTimeoutError{Phase: helm.PhasePreCommand, Timeout: phaseTimeouts[helm.PhasePreCommand], Err: err}
+		}
+		preCancel()
+		if err != nil && ctx.Err() != nil {
+			eh.Status(helm.Wrap(err, "cancelled", core.CancelledErrorKind), "pre commands cancelled: %s", err)
+		} else if err != nil {
+			eh.Status(helm.Wrap(err, "precmd failed", core.PreFailErrorKind), "unable to run pre commands: %s", err)
+		}
+	}
+
+	// helm cache
+	if cfg.CacheDir != "" {
+		log.Printf("using cache directory %s", cfg.CacheDir)
+		err = setupCache(cfg.CacheDir)
 		if err != nil {
-			log.Fatalf("unable to create precommands file: %s", err)
+			eh.Fatalf("unable to setup cache: %s", err)
 		}
-		_, err = f.WriteString(cfg.PreCommands)
+	}
+
+	// envsubst
+	if cfg.Envsubst || cfg.EnvsubstFiles {
+		// rendered values files are removed when the plugin exits
+		renderDir, err := ioutil.TempDir("", "drone-helm3-values")
 		if err != nil {
-			log.Fatalf("unable to write precommands to file: %s", err)
+			eh.Fatalf("unable to create directory for rendered values files: %s", err)
+		}
+		cleanup.Add(func() { _ = os.RemoveAll(renderDir) })
+		subst := values.NewSubstituter(
+			values.WithStrict(cfg.EnvsubstStrict),
+			values.WithPrefixes(cfg.EnvsubstPrefixes),
+			values.WithTempDir(renderDir),
+		)
+		if cfg.Envsubst {
+			log.Print("envsubst is enabled")
+			for i, val := range cfg.Values {
+				cfg.Values[i], err = subst.Eval(val)
+				if err != nil {
+					eh.Fatalf("unable to envsubst %s: %s", val, err)
+				}
+			}
+			for i, val := range cfg.ValuesString {
+				cfg.ValuesString[i], err = subst.Eval(val)
+				if err != nil {
+					eh.Fatalf("unable to envsubst %s: %s", val, err)
+				}
+			}
+		}
+		if cfg.EnvsubstFiles && cfg.ValuesYaml != "" {
+			log.Print("envsubst for values files is enabled")
+			files := strings.Split(cfg.ValuesYaml, ",")
+			for i, file := range files {
+				rendered, err := subst.EvalFile(file)
+				if err != nil {
+					eh.Fatalf("%s", err)
+				}
+				files[i] = rendered
+			}
+			cfg.ValuesYaml = strings.Join(files, ",")
+		}
+	}
+
+	// build metadata
+	description := ""
+	if cfg.InjectBuildMetadata {
+		metadata := &values.BuildMetadata{
+			Repo:        cfg.DroneRepo,
+			Commit:      cfg.DroneCommitSha,
+			Branch:      cfg.DroneBranch,
+			Tag:         cfg.DroneTag,
+			BuildNumber: cfg.DroneBuildNumber,
+			BuildLink:   cfg.DroneBuildLink,
+			Author:      cfg.DroneAuthor,
 		}
+		log.Printf("injecting build metadata below %q", cfg.BuildMetadataKey)
+		cfg.ValuesString = append(cfg.ValuesString, metadata.Values(cfg.BuildMetadataKey)...)
+		description = metadata.Description()
+	}
 
-		cmd := exec.Command("/bin/bash", scriptName)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+	// validate the values offline, helm validates them only during the upgrade
+	if cfg.Mode == "installupgrade" && (cfg.SchemaValidation || cfg.SchemaRequired) {
+		err = validateValues(cfg)
 		if err != nil {
-			log.Fatalf("unable to run pre commands: %s", err)
+			eh.Status(helm.Wrap(err, "values validation failed", core.PreFailErrorKind), "invalid values: %s", err)
 		}
 	}
 
 	// create kube config
-	if !cfg.KubeSkip {
+	if !cfg.KubeSkip && deploy {
 		err = kube.CreateKubeConfig(
 			kube.WithConfig(cfg.KubeConfig),
 			kube.WithApiServer(cfg.KubeApiServer),
@@ -144,24 +377,6 @@ func main() {
 		}
 	}
 
-	// envsubst
-	if cfg.Envsubst {
-		log.Print("envsubst is enabled")
-		var err error
-		for i, val := range cfg.Values {
-			cfg.Values[i], err = envsubst.EvalEnv(val)
-			if err != nil {
-				eh.Fatalf("unable to envsubst %s: %s", val, err)
-			}
-		}
-		for i, val := range cfg.ValuesString {
-			cfg.ValuesString[i], err = envsubst.EvalEnv(val)
-			if err != nil {
-				eh.Fatalf("unable to envsubst %s: %s", val, err)
-			}
-		}
-	}
-
 	// configure helm operation mode
 	var cmd *helm.HelmCmd
 	switch cfg.Mode {
@@ -175,11 +390,17 @@ func main() {
 		if cfg.TestRollback {
 			cfg.Test = true
 		}
+		// the build link identifies the lock holder, fall back to the build number
+		lockHolder := cfg.DroneBuildLink
+		if lockHolder == "" {
+			lockHolder = fmt.Sprintf("%s#%s", cfg.DroneRepo, cfg.DroneBuildNumber)
+		}
 
 		// create helm cmd
 		cmd, err = helm.NewHelmCmd(
 			helm.WithInstallUpgradeMode(),
 			helm.WithChart(cfg.Chart),
+			helm.WithChartVersion(cfg.ChartVersion, cfg.ChartDevel),
 			helm.WithRelease(cfg.Release),
 			helm.WithNamespace(cfg.Namespace),
 
@@ -191,14 +412,37 @@ func main() {
 			helm.WithDryRun(cfg.DryRun),
 			helm.WithDebug(cfg.HelmDebug),
 			helm.WithDisableOpenAPIValidation(cfg.DisableOpenAPIValidation),
+			helm.WithDescription(description),
 			helm.WithPostKustomization(cfg.PostKustomization),
 
-			helm.WithHelmRepos(cfg.HelmRepos),
+			helm.WithRegistryLogin(helm.RegistryLogin{
+				Host:     cfg.RegistryLoginHost,
+				Username: cfg.RegistryLoginUsername,
+				Password: cfg.RegistryLoginPassword,
+				Insecure: cfg.RegistryLoginInsecure,
+				CAFile:   cfg.RegistryLoginCAFile,
+			}),
+			helm.WithHelmRepos(repos),
 			helm.WithBuildDependencies(cfg.BuildDependencies, cfg.Chart),
 			helm.WithUpdateDependencies(cfg.UpdateDependencies, cfg.Chart),
 			helm.WithLint(cfg.Lint),
+			helm.WithCache(cfg.CacheDir, cfg.RepoCacheTTL),
 			helm.WithTest(cfg.Test, cfg.Release),
-			helm.WithTestRollback(cfg.Test, cfg.Release),
+			helm.WithTestRollback(cfg.TestRollback, cfg.Release),
+			helm.WithTestTimeout(cfg.TestTimeout),
+			helm.WithTestFilter(cfg.TestFilter),
+			helm.WithTestReport(cfg.TestReportFile),
+			helm.WithRollbackWait(cfg.RollbackWait),
+			helm.WithRollbackOnFailure(cfg.RollbackOnFailure),
+			helm.WithRecoverPending(cfg.RecoverPending),
+			helm.WithCancelCleanup(cfg.CancelCleanup, cfg.CancelTimeout),
+			helm.WithVerify(cfg.VerifyRollout, cfg.VerifyTimeout),
+			helm.WithDiagnostics(helm.Diagnostics{
+				Enabled:  cfg.Diagnostics,
+				File:     cfg.DiagnosticsFile,
+				LogLines: cfg.DiagnosticsLogs,
+			}),
+			helm.WithSmokeChecks(smokeChecks, cfg.SmokeRollback),
 
 			helm.WithValuesYamlAddDefault(cfg.ValuesYamlAddDefault, cfg.Chart),
 			helm.WithValuesYaml(cfg.ValuesYaml),
@@ -206,7 +450,59 @@ func main() {
 			helm.WithValuesString(cfg.ValuesString),
 
 			helm.WithKubeConfig(cfg.KubeConfig),
-			helm.WithRunner(NewRunner()),
+			helm.WithRunner(NewRunner(cfg.CancelGracePeriod)),
+
+			helm.WithPostHook(scriptHook(script("post commands", cfg.PostCommands), cfg.HookTimeout, false)),
+			helm.WithOnSuccess(scriptHook(script("on success commands", cfg.OnSuccessCommands), cfg.HookTimeout, true)),
+			helm.WithOnFailure(scriptHook(script("on failure commands", cfg.OnFailureCommands), cfg.HookTimeout, true)),
+			helm.WithOnRollback(scriptHook(script("on rollback commands", cfg.OnRollbackCommands), cfg.HookTimeout, true)),
+			helm.WithPhaseTimeouts(phaseTimeouts),
+			helm.WithRetry(helm.Retry{
+				Attempts: cfg.RetryAttempts,
+				Backoff:  cfg.RetryBackoff,
+				Upgrade:  cfg.RetryUpgrade,
+			}),
+			helm.WithManifestChecks(helm.ManifestChecks{
+				Rules:          manifestRules,
+				RequiredLabels: cfg.ManifestRequiredLabels,
+			}),
+			helm.WithLock(helm.Lock{
+				Enabled:  cfg.Lock,
+				Holder:   lockHolder,
+				Timeout:  cfg.LockTimeout,
+				Duration: cfg.LockDuration,
+			}),
+		)
+		if err != nil {
+			eh.Fatalf("unable to generate helm command: %s", err)
+		}
+	case "package":
+		// versions are derived from the tag
+		version := strings.TrimPrefix(cfg.DroneTag, "v")
+
+		cmd, err = helm.NewHelmCmd(
+			helm.WithPackageMode(),
+			helm.WithChart(cfg.Chart),
+
+			helm.WithHelmRepos(repos),
+			helm.WithBuildDependencies(cfg.BuildDependencies && !cfg.UpdateDependencies, cfg.Chart),
+			helm.WithUpdateDependencies(cfg.UpdateDependencies, cfg.Chart),
+			helm.WithLint(cfg.Lint),
+			helm.WithCache(cfg.CacheDir, cfg.RepoCacheTTL),
+
+			helm.WithPackageVersion(version, version),
+			helm.WithPackageDestination(cfg.PackageDestination),
+			helm.WithPackageSign(cfg.PackageSignKey, cfg.PackageKeyring, cfg.PackagePassphrase),
+			helm.WithPackagePush(cfg.PackagePush),
+			helm.WithRegistryLogin(helm.RegistryLogin{
+				Host:     cfg.RegistryLoginHost,
+				Username: cfg.RegistryLoginUsername,
+				Password: cfg.RegistryLoginPassword,
+				Insecure: cfg.RegistryLoginInsecure,
+				CAFile:   cfg.RegistryLoginCAFile,
+			}),
+
+			helm.WithRunner(NewRunner(cfg.CancelGracePeriod)),
 		)
 		if err != nil {
 			eh.Fatalf("unable to generate helm command: %s", err)
@@ -221,7 +517,7 @@ func main() {
 			helm.WithTimeout(cfg.Timeout),
 
 			helm.WithKubeConfig(cfg.KubeConfig),
-			helm.WithRunner(NewRunner()),
+			helm.WithRunner(NewRunner(cfg.CancelGracePeriod)),
 		)
 		if err != nil {
 			eh.Fatalf("unable to generate helm command: %s", err)
@@ -231,36 +527,219 @@ func main() {
 	}
 
 	// run commands
-	log.Printf("running with a timeout of %s", cfg.Timeout.String())
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout+(10*time.Minute))
-	defer cancel()
+	log.Printf("running with a timeout of %s", cmd.Timeout.String())
 	err = cmd.Run(ctx)
+	if cmd.ChartVersion != "" {
+		eh.Info("chart_version", cmd.ChartVersion)
+	}
+	if cmd.Recovered != "" {
+		eh.Info("recovered_pending", cmd.Recovered)
+	}
 	if err != nil {
-		eh.Fatalf("error running helm: %s", err)
+		eh.Status(err, "error running helm: %s", err)
 	}
-	eh.Status(err, "finished deployment successfully")
+	eh.Status(nil, "finished deployment successfully")
 }
 
-type Runner struct{}
+// maskHelmRepos renders the parsed repositories with masked credentials,
+// unparsable specifications are masked completely
+func maskHelmRepos(spec string) string {
+	repos, err := helm.ParseHelmRepos(spec)
+	if err != nil {
+		return "***"
+	}
+	masked := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		masked = append(masked, fmt.Sprintf("%+v", repo.Masked()))
+	}
+	return strings.Join(masked, ",")
+}
 
-func NewRunner() *Runner {
-	return &Runner{}
+// setupCache points the helm cache to the cache directory, the helm
+// configuration with the repository and registry credentials stays in the
+// build
+func setupCache(dir string) error {
+	if _, ok := os.LookupEnv("HELM_CACHE_HOME"); ok {
+		return nil
+	}
+	return os.Setenv("HELM_CACHE_HOME", filepath.Join(dir, "cache"))
 }
 
-func (r *Runner) Run(ctx context.Context, name string, args ...string) error {
-	printArgs := make([]string, len(args))
-	copy(printArgs, args)
-	for i := 1; i < len(printArgs); i++ {
-		if printArgs[i-1] == "--set-string" || printArgs[i-1] == "--set" {
-			kv := strings.SplitN(printArgs[i], "=", 2)
-			printArgs[i] = fmt.Sprintf("%s=***", kv[0])
+// checkPolicies checks the deployment against the policy of the image and
+// the configured policies, all of them have to allow it
+func checkPolicies(cfg *Config, repos []helm.HelmRepo) error {
+	policies := []*policy.Policy{}
+	if _, err := os.Stat(policy.DefaultFile); err == nil {
+		p, err := policy.Load(policy.DefaultFile)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, p)
+	}
+	if cfg.PolicyFile != "" {
+		p, err := policy.Load(cfg.PolicyFile)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, p)
+	}
+	if cfg.Policy != "" {
+		p, err := policy.Parse([]byte(cfg.Policy))
+		if err != nil {
+			return err
 		}
+		policies = append(policies, p)
 	}
-	log.Printf("running: %s %v", name, printArgs)
 
-	cmd := exec.CommandContext(ctx, name, args...)
-	cmd.Stderr = os.Stderr
+	req := policy.Request{
+		Repo:       cfg.DroneRepo,
+		Namespace:  cfg.Namespace,
+		Release:    cfg.Release,
+		Chart:      cfg.Chart,
+		ChartRepos: map[string]string{},
+		Event:      cfg.DroneBuildEvent,
+	}
+	for _, repo := range repos {
+		req.ChartRepos[repo.Name] = repo.URL
+	}
+	for _, p := range policies {
+		err := p.Check(req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateValues merges the values like helm and validates them against the
+// schema of a local chart, remote charts are validated by helm unless a
+// schema is required
+func validateValues(cfg *Config) error {
+	chart, err := values.LoadChart(cfg.Chart)
+	if err != nil {
+		return err
+	}
+	if chart == nil {
+		if cfg.SchemaRequired {
+			return fmt.Errorf("remote chart %s cannot be validated before the upgrade", cfg.Chart)
+		}
+		log.Printf("skipping schema validation of remote chart %q", cfg.Chart)
+		return nil
+	}
+	if len(chart.Schema) == 0 {
+		if cfg.SchemaRequired {
+			return fmt.Errorf("chart %s has no values.schema.json", cfg.Chart)
+		}
+		return nil
+	}
+
+	files := []string{}
+	if cfg.ValuesYamlAddDefault {
+		files = append(files, fmt.Sprintf("%s/values.yaml", cfg.Chart))
+	}
+	if cfg.ValuesYaml != "" {
+		files = append(files, strings.Split(cfg.ValuesYaml, ",")...)
+	}
+	for _, file := range files {
+		if strings.Contains(file, "://") {
+			if cfg.SchemaRequired {
+				return fmt.Errorf("remote values file %s cannot be validated before the upgrade", file)
+			}
+			log.Printf("skipping schema validation, remote values file %q", file)
+			return nil
+		}
+	}
+
+	merged, err := values.Merge(chart.Values, files, cfg.Values, cfg.ValuesString)
+	if err != nil {
+		return err
+	}
+	err = values.Validate(chart.Schema, merged)
+	if err != nil {
+		return err
+	}
+	log.Printf("values match the schema of chart %s", cfg.Chart)
+	return nil
+}
+
+// Runner runs external commands, a cancelled command receives SIGTERM and
+// is killed after GracePeriod
+type Runner struct {
+	GracePeriod time.Duration
+}
+
+func NewRunner(gracePeriod time.Duration) *Runner {
+	return &Runner{GracePeriod: gracePeriod}
+}
+
+func (r *Runner) Run(ctx context.Context, name string, args ...string) error {
+	return r.RunWithStdin(ctx, nil, name, args...)
+}
+
+func (r *Runner) RunWithStdin(ctx context.Context, stdin io.Reader, name string, args ...string) error {
+	cmd := r.command(name, args...)
+	cmd.Stdin = stdin
 	defer os.Stdout.Sync()
 	defer os.Stderr.Sync()
-	return cmd.Run()
+	return r.wait(ctx, cmd)
+}
+
+func (r *Runner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := r.command(name, args...)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	defer os.Stderr.Sync()
+	err := r.wait(ctx, cmd)
+	return out.Bytes(), err
+}
+
+// wait runs the command until it exits, if ctx is done SIGTERM is forwarded
+// so helm can release its lock and the command is killed after the grace
+// period. The error output is captured to classify errors.
+func (r *Runner) wait(ctx context.Context, cmd *exec.Cmd) error {
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	err := r.start(ctx, cmd)
+	if err != nil {
+		return &helm.CommandError{Err: err, Stderr: stderr.String()}
+	}
+	return nil
+}
+
+func (r *Runner) start(ctx context.Context, cmd *exec.Cmd) error {
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("sending SIGTERM to %s", cmd.Path)
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err = <-done:
+	case <-time.After(r.GracePeriod):
+		log.Printf("killing %s after grace period of %s", cmd.Path, r.GracePeriod)
+		_ = cmd.Process.Kill()
+		err = <-done
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+func (r *Runner) command(name string, args ...string) *exec.Cmd {
+	log.Printf("running: %s %v", name, redact.Args(args))
+
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	return cmd
 }
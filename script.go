@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/bitsbeats/drone-helm3/internal/helm"
+)
+
+type (
+	// Script is a shell script executed from a private temporary file
+	Script struct {
+		Name   string
+		Body   string
+		Strict bool
+
+		// Stdout and Stderr receive the output, used for redaction
+		Stdout io.Writer
+		Stderr io.Writer
+	}
+
+	// flusher is implemented by buffering writers
+	flusher interface {
+		Flush() error
+	}
+
+	// output is a pipe for the output of a script, done is closed once the
+	// output is copied
+	output struct {
+		r, w *os.File
+		done chan struct{}
+	}
+)
+
+// outputDrain limits the wait for output after the script exited, background
+// processes of the script may keep the pipes open
+const outputDrain = time.Second
+
+// Run executes the script with bash, the additional environment is
+// appended to the environment of the plugin
+func (s *Script) Run(ctx context.Context, env ...string) error {
+	f, err := ioutil.TempFile("", "drone-helm3-*.sh")
+	if err != nil {
+		return fmt.Errorf("unable to create %s file: %s", s.Name, err)
+	}
+	defer os.Remove(f.Name())
+	body := s.Body
+	if s.Strict {
+		body = "set -euo pipefail\n" + body
+	}
+	_, err = f.WriteString(body)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write %s to file: %s", s.Name, err)
+	}
+
+	cmd := exec.Command("/bin/bash", f.Name())
+	cmd.Env = append(os.Environ(), env...)
+	// the script gets its own process group so background processes are
+	// killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	log.Printf("running %s", s.Name)
+	err = s.run(ctx, cmd)
+	for _, w := range []io.Writer{s.Stdout, s.Stderr} {
+		if f, ok := w.(flusher); ok {
+			_ = f.Flush()
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out", s.Name)
+	} else if ctx.Err() != nil {
+		return fmt.Errorf("%s cancelled: %s", s.Name, ctx.Err())
+	} else if err != nil {
+		return fmt.Errorf("%s failed: %s", s.Name, err)
+	}
+	return nil
+}
+
+// run starts cmd and waits until it exits or ctx is done, then the process
+// group is killed. The output is copied from pipes owned by the plugin, so a
+// background process that inherited them can not block the return.
+func (s *Script) run(ctx context.Context, cmd *exec.Cmd) error {
+	stdout, err := newOutput(s.Stdout)
+	if err != nil {
+		return err
+	}
+	stderr, err := newOutput(s.Stderr)
+	if err != nil {
+		stdout.close()
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = stdout.w, stderr.w
+	err = cmd.Start()
+	// only the script holds the writing ends now
+	_ = stdout.w.Close()
+	_ = stderr.w.Close()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			err = <-done
+		}
+	}
+
+	deadline := time.Now().Add(outputDrain)
+	for _, o := range []*output{stdout, stderr} {
+		select {
+		case <-o.done:
+		case <-time.After(time.Until(deadline)):
+		}
+		if ctx.Err() != nil {
+			// background processes that survived the kill are cut off
+			_ = o.r.Close()
+		}
+	}
+	return err
+}
+
+// newOutput copies everything written to the pipe to dst until all writing
+// ends are closed
+func newOutput(dst io.Writer) (*output, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	if dst == nil {
+		dst = ioutil.Discard
+	}
+	o := &output{r: r, w: w, done: make(chan struct{})}
+	go func() {
+		defer close(o.done)
+		_, _ = io.Copy(dst, r)
+	}()
+	return o, nil
+}
+
+func (o *output) close() {
+	_ = o.w.Close()
+	_ = o.r.Close()
+}
+
+// scriptHook returns a helm.Hook that runs the script with the outcome in
+// its environment, nil if the script is empty. Detached hooks ignore the
+// context of the run.
+func scriptHook(script *Script, timeout time.Duration, detached bool) helm.Hook {
+	if script.Body == "" {
+		return nil
+	}
+	return func(ctx context.Context, outcome *helm.Outcome) error {
+		// hooks have their own timeout, failure hooks need to run even if
+		// the deployment ran out of time
+		if detached {
+			ctx = context.Background()
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return script.Run(ctx, outcome.Env()...)
+	}
+}